@@ -0,0 +1,247 @@
+package garnish
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// Picks which of an upstream's transports should handle a request
+type Balancer interface {
+	// Pick a transport for the request. transports is never empty, but
+	// it only contains the transports currently available (healthy,
+	// not ejected, not yet tried). req can be nil.
+	Pick(req *Request, transports []*Transport) *Transport
+}
+
+// Implemented by balancers which need to know about all of the upstream's
+// transports, not just those currently available. Called whenever the
+// upstream's transports change.
+type TransportAware interface {
+	SetTransports(transports []*Transport)
+}
+
+// Creates a balancer from its name. Valid names are:
+// random, roundrobin, weighted, leastoutstanding, p2c and hash
+func NewBalancer(name string) (Balancer, error) {
+	switch name {
+	case "", "random":
+		return RandomBalancer{}, nil
+	case "roundrobin":
+		return new(RoundRobinBalancer), nil
+	case "weighted":
+		return NewWeightedBalancer(), nil
+	case "leastoutstanding":
+		return LeastOutstandingBalancer{}, nil
+	case "p2c":
+		return PowerOfTwoBalancer{}, nil
+	case "hash":
+		return NewHashBalancer(nil), nil
+	}
+	return nil, fmt.Errorf("unknown balancer %q", name)
+}
+
+// Picks a transport at random
+type RandomBalancer struct{}
+
+func (_ RandomBalancer) Pick(req *Request, transports []*Transport) *Transport {
+	return transports[rand.Intn(len(transports))]
+}
+
+// Cycles through each transport in turn
+type RoundRobinBalancer struct {
+	counter uint64
+}
+
+func (b *RoundRobinBalancer) Pick(req *Request, transports []*Transport) *Transport {
+	n := atomic.AddUint64(&b.counter, 1)
+	return transports[n%uint64(len(transports))]
+}
+
+// Smooth weighted round robin (the same algorithm nginx uses). A transport
+// with a weight of 3 gets picked 3 times as often as one with a weight of 1,
+// without those picks being bunched together.
+type WeightedBalancer struct {
+	sync.Mutex
+	current map[*Transport]int
+}
+
+func NewWeightedBalancer() *WeightedBalancer {
+	return &WeightedBalancer{
+		current: make(map[*Transport]int),
+	}
+}
+
+func (b *WeightedBalancer) Pick(req *Request, transports []*Transport) *Transport {
+	b.Lock()
+	defer b.Unlock()
+
+	total := 0
+	var best *Transport
+	for _, t := range transports {
+		weight := t.weight()
+		total += weight
+		current := b.current[t] + weight
+		b.current[t] = current
+		if best == nil || current > b.current[best] {
+			best = t
+		}
+	}
+	b.current[best] -= total
+
+	// transports can come and go (reload, health), don't hold on to old ones
+	if len(b.current) > len(transports)*2 {
+		b.current = make(map[*Transport]int, len(transports))
+	}
+	return best
+}
+
+// Picks the transport with the fewest in-flight requests
+type LeastOutstandingBalancer struct{}
+
+func (_ LeastOutstandingBalancer) Pick(req *Request, transports []*Transport) *Transport {
+	l := len(transports)
+	// start at a random offset so that ties don't all go to the first transport
+	offset := rand.Intn(l)
+	best := transports[offset]
+	for i := 1; i < l; i++ {
+		t := transports[(offset+i)%l]
+		if t.Outstanding() < best.Outstanding() {
+			best = t
+		}
+	}
+	return best
+}
+
+// Picks two transports at random and uses the one with the fewest
+// in-flight requests
+type PowerOfTwoBalancer struct{}
+
+func (_ PowerOfTwoBalancer) Pick(req *Request, transports []*Transport) *Transport {
+	l := len(transports)
+	if l == 1 {
+		return transports[0]
+	}
+	i := rand.Intn(l)
+	j := rand.Intn(l - 1)
+	if j >= i {
+		j++
+	}
+	a, b := transports[i], transports[j]
+	if b.Outstanding() < a.Outstanding() {
+		return b
+	}
+	return a
+}
+
+// The number of points each transport (per unit of weight) gets on the
+// hash ring
+const HashReplicas = 100
+
+// Extracts the key a request is hashed on
+type HashKey func(req *Request) string
+
+// Sends requests with the same key to the same transport. Transports are
+// placed on a ring (many times, to spread the load evenly) based on their
+// address. Since the position doesn't depend on the other transports,
+// adding or removing a transport (say, on reload) only moves the keys
+// which belonged to it. When the owner of a key isn't available, the next
+// transport on the ring is used.
+type HashBalancer struct {
+	sync.RWMutex
+	Key    HashKey
+	hashes []uint64
+	owners []*Transport
+	count  int
+}
+
+// Creates a hash balancer. When key is nil, the route's primary cache key
+// is used (or the URL's path for routes which aren't cached)
+func NewHashBalancer(key HashKey) *HashBalancer {
+	if key == nil {
+		key = DefaultHashKey
+	}
+	return &HashBalancer{Key: key}
+}
+
+func DefaultHashKey(req *Request) string {
+	if route := req.Route; route != nil && route.Cache != nil && route.Cache.KeyLookup != nil {
+		primary, _ := route.Cache.KeyLookup(req)
+		return primary
+	}
+	return req.URL.Path
+}
+
+func (b *HashBalancer) SetTransports(transports []*Transport) {
+	l := 0
+	for _, t := range transports {
+		l += t.weight() * HashReplicas
+	}
+	hashes := make([]uint64, 0, l)
+	owners := make(map[uint64]*Transport, l)
+	for _, t := range transports {
+		for i, n := 0, t.weight()*HashReplicas; i < n; i++ {
+			h := hash(t.Address + "-" + strconv.Itoa(i))
+			if _, exists := owners[h]; exists == false {
+				hashes = append(hashes, h)
+			}
+			owners[h] = t
+		}
+	}
+	sort.Slice(hashes, func(i, j int) bool { return hashes[i] < hashes[j] })
+	ordered := make([]*Transport, len(hashes))
+	for i, h := range hashes {
+		ordered[i] = owners[h]
+	}
+
+	b.Lock()
+	b.hashes, b.owners, b.count = hashes, ordered, len(transports)
+	b.Unlock()
+}
+
+func (b *HashBalancer) Pick(req *Request, transports []*Transport) *Transport {
+	b.RLock()
+	hashes, owners, count := b.hashes, b.owners, b.count
+	b.RUnlock()
+	if req == nil || len(hashes) == 0 {
+		return RandomBalancer{}.Pick(req, transports)
+	}
+
+	h := hash(b.Key(req))
+	start := sort.Search(len(hashes), func(i int) bool { return hashes[i] >= h })
+
+	// the common case: every transport is available
+	if len(transports) == count {
+		return owners[start%len(owners)]
+	}
+
+	candidates := make(map[*Transport]struct{}, len(transports))
+	for _, t := range transports {
+		candidates[t] = struct{}{}
+	}
+	for i := 0; i < len(owners); i++ {
+		t := owners[(start+i)%len(owners)]
+		if _, ok := candidates[t]; ok {
+			return t
+		}
+	}
+	// transports we've never been told about
+	return RandomBalancer{}.Pick(req, transports)
+}
+
+func hash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	// fnv alone clusters similar keys (like "address-1", "address-2")
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
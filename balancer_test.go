@@ -0,0 +1,127 @@
+package garnish
+
+import (
+	. "github.com/karlseguin/expect"
+	"strconv"
+	"testing"
+)
+
+type BalancerTests struct{}
+
+func Test_Balancer(t *testing.T) {
+	Expectify(new(BalancerTests), t)
+}
+
+func (_ BalancerTests) CreatesBalancersByName() {
+	for _, name := range []string{"", "random", "roundrobin", "weighted", "leastoutstanding", "p2c", "hash"} {
+		b, err := NewBalancer(name)
+		Expect(err).To.Equal(nil)
+		Expect(b == nil).To.Equal(false)
+	}
+	_, err := NewBalancer("fastest")
+	Expect(err.Error()).To.Equal(`unknown balancer "fastest"`)
+}
+
+func (_ BalancerTests) RoundRobinCycles() {
+	transports := testTransports("a", "b", "c")
+	b := new(RoundRobinBalancer)
+	hits := make(map[string]int)
+	for i := 0; i < 9; i++ {
+		hits[b.Pick(nil, transports).Address]++
+	}
+	Expect(hits["a"]).To.Equal(3)
+	Expect(hits["b"]).To.Equal(3)
+	Expect(hits["c"]).To.Equal(3)
+}
+
+func (_ BalancerTests) WeightedHonorsWeights() {
+	transports := testTransports("a", "b", "c")
+	transports[0].Weight = 3
+	transports[2].Weight = 0
+	b := NewWeightedBalancer()
+	picks := ""
+	for i := 0; i < 10; i++ {
+		picks += b.Pick(nil, transports).Address
+	}
+	Expect(picks).To.Equal("abacaabaca")
+}
+
+func (_ BalancerTests) LeastOutstandingPicksTheLeastBusy() {
+	transports := testTransports("a", "b", "c")
+	transports[0].outstanding = 4
+	transports[1].outstanding = 1
+	transports[2].outstanding = 2
+	for i := 0; i < 10; i++ {
+		Expect(LeastOutstandingBalancer{}.Pick(nil, transports).Address).To.Equal("b")
+	}
+}
+
+func (_ BalancerTests) PowerOfTwoNeverPicksTheBusiest() {
+	transports := testTransports("a", "b", "c")
+	transports[0].outstanding = 4
+	for i := 0; i < 100; i++ {
+		Expect(PowerOfTwoBalancer{}.Pick(nil, transports).Address).Not.To.Equal("a")
+	}
+}
+
+func (_ BalancerTests) HashIsSticky() {
+	transports := testTransports("a", "b", "c")
+	b := testHashBalancer(transports)
+	for i := 0; i < 20; i++ {
+		key := &Request{Id: strconv.Itoa(i)}
+		first := b.Pick(key, transports)
+		Expect(b.Pick(key, transports)).To.Equal(first)
+		Expect(b.Pick(key, transports)).To.Equal(first)
+	}
+}
+
+func (_ BalancerTests) HashFallsBackToTheNextTransport() {
+	transports := testTransports("a", "b", "c")
+	b := testHashBalancer(transports)
+	for i := 0; i < 100; i++ {
+		key := &Request{Id: strconv.Itoa(i)}
+		first := b.Pick(key, transports)
+		var available []*Transport
+		for _, t := range transports {
+			if t != first {
+				available = append(available, t)
+			}
+		}
+		second := b.Pick(key, available)
+		Expect(second).Not.To.Equal(first)
+		// the same transport the ring would pick without the first one
+		Expect(testHashBalancer(available).Pick(key, available).Address).To.Equal(second.Address)
+	}
+}
+
+func (_ BalancerTests) HashOnlyMovesKeysOfRemovedTransports() {
+	before := testTransports("a", "b", "c", "d")
+	after := testTransports("a", "b", "c")
+	b1, b2 := testHashBalancer(before), testHashBalancer(after)
+	hits := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		key := &Request{Id: strconv.Itoa(i)}
+		was, is := b1.Pick(key, before).Address, b2.Pick(key, after).Address
+		if was != "d" {
+			Expect(is).To.Equal(was)
+		}
+		hits[was]++
+	}
+	for _, address := range []string{"a", "b", "c", "d"} {
+		Expect(hits[address] > 150).To.Equal(true)
+	}
+}
+
+func testHashBalancer(transports []*Transport) *HashBalancer {
+	b := NewHashBalancer(func(req *Request) string { return req.Id })
+	b.SetTransports(transports)
+	return b
+}
+
+func testTransports(addresses ...string) []*Transport {
+	transports := make([]*Transport, len(addresses))
+	for i, address := range addresses {
+		transports[i] = &Transport{Address: address}
+	}
+	return transports
+}
@@ -0,0 +1,173 @@
+package garnish
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	CIRCUIT_CLOSED = iota
+	CIRCUIT_OPEN
+	CIRCUIT_HALF_OPEN
+)
+
+// Returned (by the upstream middleware) when a circuit breaker rejects a request
+var ErrCircuitOpen = errors.New("circuit open")
+
+var circuitNames = []string{"closed", "open", "half-open"}
+
+// A circuit breaker which opens when the failure rate within a window is
+// too high. While open, requests are rejected without being sent. Once
+// Open has elapsed, a limited number of requests are let through
+// (half-open). If they all succeed, the circuit closes, if any of them
+// fail, it opens again.
+type CircuitBreaker struct {
+	sync.Mutex
+	Name string
+
+	// The failure rate (0 - 1) which opens the circuit, once MinRequests
+	// have been seen within Window
+	FailureRate float64
+	MinRequests int
+	Window      time.Duration
+
+	// How long the circuit stays open for
+	Open time.Duration
+
+	// The number of requests let through while half-open
+	HalfOpen int
+
+	state       int
+	openedAt    time.Time
+	windowStart time.Time
+	requests    int
+	failures    int
+	inFlight    int
+	successes   int
+	opened      int64
+	rejected    int64
+}
+
+// Copies the breaker's settings (but not its state) under a new name
+func (b *CircuitBreaker) Clone(name string) *CircuitBreaker {
+	return &CircuitBreaker{
+		Name:        name,
+		FailureRate: b.FailureRate,
+		MinRequests: b.MinRequests,
+		Window:      b.Window,
+		Open:        b.Open,
+		HalfOpen:    b.HalfOpen,
+	}
+}
+
+// Whether a request can be sent. Must be followed by a call to Record
+// when true is returned.
+func (b *CircuitBreaker) Allow() bool {
+	b.Lock()
+	defer b.Unlock()
+	switch b.state {
+	case CIRCUIT_CLOSED:
+		return true
+	case CIRCUIT_OPEN:
+		if time.Since(b.openedAt) < b.Open {
+			b.rejected++
+			return false
+		}
+		b.transition(CIRCUIT_HALF_OPEN)
+	}
+	if b.inFlight >= b.HalfOpen {
+		b.rejected++
+		return false
+	}
+	b.inFlight++
+	return true
+}
+
+// Gives back a request allowed by Allow which ended up not being sent
+func (b *CircuitBreaker) Release() {
+	b.Lock()
+	if b.state == CIRCUIT_HALF_OPEN && b.inFlight > 0 {
+		b.inFlight--
+	}
+	b.Unlock()
+}
+
+// Like Allow, but doesn't count anything. Used to skip transports
+// whose circuit would reject the request.
+func (b *CircuitBreaker) Ready(now time.Time) bool {
+	b.Lock()
+	defer b.Unlock()
+	switch b.state {
+	case CIRCUIT_OPEN:
+		return now.Sub(b.openedAt) >= b.Open
+	case CIRCUIT_HALF_OPEN:
+		return b.inFlight < b.HalfOpen
+	}
+	return true
+}
+
+// Records the outcome of a request
+func (b *CircuitBreaker) Record(ok bool) {
+	b.Lock()
+	defer b.Unlock()
+	switch b.state {
+	case CIRCUIT_CLOSED:
+		now := time.Now()
+		if now.Sub(b.windowStart) > b.Window {
+			b.windowStart, b.requests, b.failures = now, 0, 0
+		}
+		b.requests++
+		if ok == false {
+			b.failures++
+			if b.requests >= b.MinRequests && float64(b.failures)/float64(b.requests) >= b.FailureRate {
+				b.transition(CIRCUIT_OPEN)
+			}
+		}
+	case CIRCUIT_HALF_OPEN:
+		if b.inFlight > 0 {
+			b.inFlight--
+		}
+		if ok == false {
+			b.transition(CIRCUIT_OPEN)
+			return
+		}
+		b.successes++
+		if b.successes >= b.HalfOpen {
+			b.transition(CIRCUIT_CLOSED)
+		}
+	}
+}
+
+func (b *CircuitBreaker) State() int {
+	b.Lock()
+	defer b.Unlock()
+	return b.state
+}
+
+func (b *CircuitBreaker) Stats() map[string]int64 {
+	b.Lock()
+	defer b.Unlock()
+	stats := map[string]int64{
+		"state":    int64(b.state),
+		"opened":   b.opened,
+		"rejected": b.rejected,
+	}
+	b.opened, b.rejected = 0, 0
+	return stats
+}
+
+// must be called under lock
+func (b *CircuitBreaker) transition(state int) {
+	Log.Warnf("circuit %s is %s (was %s)", b.Name, circuitNames[state], circuitNames[b.state])
+	b.state = state
+	switch state {
+	case CIRCUIT_OPEN:
+		b.opened++
+		b.openedAt = time.Now()
+	case CIRCUIT_HALF_OPEN:
+		b.inFlight, b.successes = 0, 0
+	case CIRCUIT_CLOSED:
+		b.windowStart, b.requests, b.failures = time.Now(), 0, 0
+	}
+}
@@ -0,0 +1,70 @@
+package garnish
+
+import (
+	. "github.com/karlseguin/expect"
+	"testing"
+	"time"
+)
+
+type BreakerTests struct{}
+
+func Test_Breaker(t *testing.T) {
+	Log = NewFakeLogger()
+	Expectify(new(BreakerTests), t)
+}
+
+func (_ BreakerTests) OpensOnFailureRate() {
+	b := testBreaker()
+	b.Record(true)
+	b.Record(false)
+	b.Record(true)
+	Expect(b.State()).To.Equal(CIRCUIT_CLOSED)
+	b.Record(false)
+	Expect(b.State()).To.Equal(CIRCUIT_OPEN)
+	Expect(b.Allow()).To.Equal(false)
+	Expect(b.Stats()["rejected"]).To.Equal(int64(1))
+}
+
+func (_ BreakerTests) HalfOpenClosesOnSuccess() {
+	b := testBreaker()
+	b.transition(CIRCUIT_OPEN)
+	b.openedAt = time.Now().Add(-time.Minute)
+	Expect(b.Ready(time.Now())).To.Equal(true)
+	Expect(b.Allow()).To.Equal(true)
+	Expect(b.Allow()).To.Equal(true)
+	Expect(b.Allow()).To.Equal(false)
+	Expect(b.State()).To.Equal(CIRCUIT_HALF_OPEN)
+	b.Record(true)
+	b.Record(true)
+	Expect(b.State()).To.Equal(CIRCUIT_CLOSED)
+}
+
+func (_ BreakerTests) HalfOpenReopensOnFailure() {
+	b := testBreaker()
+	b.transition(CIRCUIT_OPEN)
+	b.openedAt = time.Now().Add(-time.Minute)
+	Expect(b.Allow()).To.Equal(true)
+	b.Record(false)
+	Expect(b.State()).To.Equal(CIRCUIT_OPEN)
+	Expect(b.Ready(time.Now())).To.Equal(false)
+}
+
+func (_ BreakerTests) SkipsTransportsWithAnOpenCircuit() {
+	u := &MultiTransportUpstream{transports: testTransports("a", "b")}
+	u.transports[0].Breaker = testBreaker()
+	u.transports[0].Breaker.transition(CIRCUIT_OPEN)
+	for i := 0; i < 10; i++ {
+		Expect(u.Transport(nil).Address).To.Equal("b")
+	}
+}
+
+func testBreaker() *CircuitBreaker {
+	return &CircuitBreaker{
+		Name:        "test",
+		FailureRate: 0.5,
+		MinRequests: 4,
+		Window:      time.Minute,
+		Open:        time.Second,
+		HalfOpen:    2,
+	}
+}
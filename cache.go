@@ -1,6 +1,8 @@
 package garnish
 
 import (
+	"context"
+	"net/http"
 	"strconv"
 	"strings"
 	"sync"
@@ -70,22 +72,134 @@ type Cache struct {
 	Saint        bool
 	GraceTTL     time.Duration
 	PurgeHandler PurgeHandler
+
+	// The most variants to cache for a response which Varies, 0 for no limit
+	MaxVariants int
+
+	// Give cached responses without an ETag a hash of their body as one
+	ETags bool
 }
 
 func NewCache() *Cache {
 	return &Cache{
-		downloads: make(map[string]time.Time),
+		downloads:   make(map[string]time.Time),
+		MaxVariants: 16,
+	}
+}
+
+// Gets the request's entry. When the responses stored under the keys Vary,
+// this is the variant for the request's headers. Also returns the secondary
+// key the entry is stored under
+func (c *Cache) Get(req *Request, primary string, secondary string) (CachedResponse, string) {
+	item := c.Storage.Get(primary, secondary)
+	if item == nil || isVaryMarker(item) == false {
+		return item, secondary
 	}
+	fields, _ := varyFields(item.Header())
+	secondary += varyKey(req, fields)
+	return c.Storage.Get(primary, secondary), secondary
 }
 
-func (c *Cache) Set(primary string, secondary string, config *RouteCache, res Response) {
+// Caches the response to req. A response which Varies is stored as one of
+// the entry's variants (Vary: * isn't cached)
+func (c *Cache) Set(req *Request, primary string, secondary string, config *RouteCache, res Response) {
 	ttl := c.ttl(config, res)
 	if ttl == 0 {
 		return
 	}
+	fields, all := varyFields(res.Header())
+	if all || config.Limits.Cacheable(res) == false {
+		return
+	}
+
+	var key string
+	var variants []string
+	if len(fields) > 0 {
+		key = varyKey(req, fields)
+		if marker := c.Storage.Get(primary, secondary); marker != nil && isVaryMarker(marker) {
+			variants = markerVariants(marker, fields)
+		}
+		known := false
+		for _, v := range variants {
+			if v == key {
+				known = true
+				break
+			}
+		}
+		if known == false {
+			if c.MaxVariants > 0 && len(variants) >= c.MaxVariants {
+				Log.Warnf("too many variants for %q %q", primary, secondary)
+				return
+			}
+			variants = append(variants, key)
+		}
+	}
 
-	cacheable := res.ToCacheable(time.Now().Add(ttl))
-	c.Storage.Set(primary, secondary, cacheable)
+	expires := time.Now().Add(ttl)
+	cacheable := res.ToCacheable(expires)
+	if cacheable == nil {
+		return
+	}
+	if c.ETags {
+		generateETag(cacheable)
+	}
+	if len(fields) == 0 {
+		c.Storage.Set(primary, secondary, cacheable)
+		return
+	}
+	c.Storage.Set(primary, secondary+key, cacheable)
+	c.Storage.Set(primary, secondary, newVaryMarker(fields, variants, expires))
+}
+
+// Refreshes an entry the upstream answered a revalidation of with a 304.
+// The 304's caching headers replace the entry's and its expiry is pushed
+// out (unless, with the new headers, it's no longer cacheable). secondary is
+// the key the entry is stored under. Returns the refreshed entry
+func (c *Cache) Revalidated(primary string, secondary string, config *RouteCache, item CachedResponse, res Response) CachedResponse {
+	n, ok := unwrap(item).(*NormalResponse)
+	if ok == false {
+		if ttl := c.ttl(config, item); ttl > 0 {
+			item.Expire(time.Now().Add(ttl))
+		}
+		return item
+	}
+	// the entry is being served concurrently, so it's replaced rather than
+	// changed in place (the body is never modified once cached)
+	fresh := &NormalResponse{
+		body:          n.body,
+		status:        n.status,
+		header:        make(http.Header, len(n.header)),
+		expires:       n.expires,
+		generatedETag: n.generatedETag,
+	}
+	for k, v := range n.header {
+		fresh.header[k] = v
+	}
+	for _, name := range notModifiedHeaders {
+		if values, ok := res.Header()[name]; ok {
+			fresh.header[name] = values
+		}
+	}
+	if _, ok := res.Header()["Etag"]; ok {
+		// the upstream's own
+		fresh.generatedETag = false
+	}
+	if ttl := c.ttl(config, fresh); ttl > 0 {
+		fresh.expires = time.Now().Add(ttl)
+	}
+	c.Storage.Set(primary, secondary, fresh)
+	return fresh
+}
+
+// Storages can wrap the responses they hold (exposing them with Unwrap)
+func unwrap(item CachedResponse) CachedResponse {
+	for {
+		u, ok := item.(interface{ Unwrap() CachedResponse })
+		if ok == false {
+			return item
+		}
+		item = u.Unwrap()
+	}
 }
 
 func (c *Cache) ttl(config *RouteCache, res Response) time.Duration {
@@ -127,6 +241,13 @@ func (c *Cache) Grace(primary string, secondary string, req *Request, next Handl
 }
 
 func (c *Cache) grace(key string, primary string, secondary string, req *Request, next Handler) {
+	// the refresh outlives the client which triggered it, so it shouldn't be
+	// cancelled when that client goes away
+	req.Request = req.Request.WithContext(context.WithoutCancel(req.Request.Context()))
+	if req.Method == "HEAD" {
+		// refresh the GET entry the HEAD was served from
+		req.Request.Method = "GET"
+	}
 	defer func() {
 		req.Close()
 		c.Lock()
@@ -140,10 +261,14 @@ func (c *Cache) grace(key string, primary string, secondary string, req *Request
 		return
 	}
 	defer res.Close()
-	if res.Status() >= 500 {
+	if req.Stale != nil && res.Status() == 304 {
+		// the stale entry might be one of the key's variants
+		_, stored := c.Get(req, primary, secondary)
+		c.Revalidated(primary, stored, req.Route.Cache, req.Stale, res)
+	} else if res.Status() >= 500 {
 		Log.Errorf("grace error for %q", req.URL)
 	} else {
-		c.Set(primary, secondary, req.Route.Cache, res)
+		c.Set(req, primary, secondary, req.Route.Cache, res)
 	}
 }
 
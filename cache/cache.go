@@ -21,6 +21,11 @@ type Entry struct {
 	size      int
 }
 
+// The response the entry holds, for code which needs its concrete type
+func (e *Entry) Unwrap() garnish.CachedResponse {
+	return e.CachedResponse
+}
+
 type Cache struct {
 	list        *List
 	maxSize     int
@@ -1,10 +1,12 @@
 package garnish
 
 import (
+	"context"
 	. "github.com/karlseguin/expect"
 	"github.com/karlseguin/expect/build"
 	"gopkg.in/karlseguin/params.v2"
 	"net/http"
+	"sync"
 	"testing"
 	"time"
 )
@@ -82,6 +84,98 @@ func (ct *CacheTests) GraceDownload() {
 	Expect(res.Cached()).To.Equal(true)
 }
 
+func (_ CacheTests) GraceIsNotCancelledWithTheClient() {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	route := &Route{Cache: &RouteCache{TTL: time.Minute}}
+	req := NewRequest(build.Request().Request.WithContext(ctx), route, params.New(0))
+
+	c := newCache()
+	aborted := true
+	c.grace("abcd", "ab", "cd", req, func(req *Request) Response {
+		aborted = req.Aborted()
+		return Respond(200, "ok")
+	})
+	Expect(aborted).To.Equal(false)
+}
+
+func (_ CacheTests) GraceRevalidatesTheStaleEntry() {
+	route := &Route{Cache: &RouteCache{TTL: time.Minute}}
+	req := NewRequest(build.Request().Request, route, params.New(0))
+	stale := RespondH(200, http.Header{"Etag": []string{`"v1"`}}, "body").ToCacheable(time.Now().Add(-time.Second))
+	req.Stale = stale
+
+	c := newCache()
+	c.grace("abcd", "ab", "cd", req, func(req *Request) Response {
+		return EmptyH(304, http.Header{"Etag": []string{`"v1"`}, "Cache-Control": []string{"public"}})
+	})
+	fresh := c.Storage.Get("ab", "cd")
+	Expect(fresh.Expires().After(time.Now().Add(time.Second * 50))).To.Equal(true)
+	Expect(fresh.Header().Get("Cache-Control")).To.Equal("public")
+	Expect(string(fresh.(*NormalResponse).body)).To.Equal("body")
+	// replaced, not changed in place, since it might be being served
+	Expect(stale.Header().Get("Cache-Control")).To.Equal("")
+}
+
+func (_ CacheTests) RevalidatesWhileServing() {
+	config := &RouteCache{TTL: time.Minute}
+	item := RespondH(200, http.Header{"Etag": []string{`"v1"`}}, "body").ToCacheable(time.Now().Add(-time.Second))
+	c := newCache()
+	c.Storage.Set("ab", "cd", item)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			c.Revalidated("ab", "cd", config, item, EmptyH(304, http.Header{"Etag": []string{`"v1"`}, "Cache-Control": []string{"public"}}))
+		}
+	}()
+	req := NewRequest(build.Request().Header("If-None-Match", `"v1"`).Request, &Route{}, params.New(0))
+	for i := 0; i < 100; i++ {
+		Expect(NotModified(req, item)).Not.To.Equal(nil)
+		Expect(GeneratedETag(item)).To.Equal(false)
+		Expect(item.Header().Get("Cache-Control")).To.Equal("")
+	}
+	wg.Wait()
+	Expect(c.Storage.Get("ab", "cd").Header().Get("Cache-Control")).To.Equal("public")
+}
+
+func (_ CacheTests) CachesEachVariant() {
+	c := newCache()
+	config := &RouteCache{TTL: time.Minute}
+	for _, language := range []string{"en-US, fr", "de"} {
+		req := NewRequest(build.Request().Header("Accept-Language", language).Request, &Route{}, params.New(0))
+		c.Set(req, "p", "s", config, RespondH(200, http.Header{"Vary": []string{"accept-language"}}, language))
+	}
+
+	for language, body := range map[string]string{"en-us,fr": "en-US, fr", "de": "de"} {
+		item, _ := c.Get(NewRequest(build.Request().Header("Accept-Language", language).Request, &Route{}, params.New(0)), "p", "s")
+		Expect(string(item.(*NormalResponse).body)).To.Equal(body)
+	}
+	item, _ := c.Get(NewRequest(build.Request().Header("Accept-Language", "it").Request, &Route{}, params.New(0)), "p", "s")
+	Expect(item).To.Equal(nil)
+}
+
+func (_ CacheTests) DoesNotCacheVaryStar() {
+	c := newCache()
+	c.Set(NewRequest(build.Request().Header("Accept", "*/*").Request, &Route{}, params.New(0)), "p", "s", &RouteCache{TTL: time.Minute}, RespondH(200, http.Header{"Vary": []string{"*"}}, "x"))
+	Expect(c.Storage.Get("p", "s")).To.Equal(nil)
+}
+
+func (_ CacheTests) CapsTheNumberOfVariants() {
+	c := newCache()
+	c.MaxVariants = 2
+	config := &RouteCache{TTL: time.Minute}
+	for _, accept := range []string{"a", "b", "c"} {
+		c.Set(NewRequest(build.Request().Header("Accept", accept).Request, &Route{}, params.New(0)), "p", "s", config, RespondH(200, http.Header{"Vary": []string{"Accept"}}, accept))
+	}
+	item, _ := c.Get(NewRequest(build.Request().Header("Accept", "b").Request, &Route{}, params.New(0)), "p", "s")
+	Expect(string(item.(*NormalResponse).body)).To.Equal("b")
+	item, _ = c.Get(NewRequest(build.Request().Header("Accept", "c").Request, &Route{}, params.New(0)), "p", "s")
+	Expect(item).To.Equal(nil)
+}
+
 func newCache() *Cache {
 	c := NewCache()
 	c.Storage = &FakeStorage{
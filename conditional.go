@@ -0,0 +1,92 @@
+package garnish
+
+import (
+	"encoding/hex"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// The headers a 304 carries over from the cached response
+var notModifiedHeaders = []string{"Etag", "Last-Modified", "Cache-Control", "Expires", "Vary", "Content-Location"}
+
+// Returns a 304 when the request's If-None-Match or If-Modified-Since
+// matches the cached response's ETag or Last-Modified, nil otherwise
+func NotModified(req *Request, item CachedResponse) Response {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		return nil
+	}
+	header := item.Header()
+	if inm := req.Header.Get("If-None-Match"); len(inm) > 0 {
+		// If-Modified-Since is ignored when If-None-Match is present
+		if etagMatches(inm, header.Get("Etag")) == false {
+			return nil
+		}
+	} else if ims := req.Header.Get("If-Modified-Since"); len(ims) > 0 {
+		since, err := http.ParseTime(ims)
+		if err != nil {
+			return nil
+		}
+		modified, err := http.ParseTime(header.Get("Last-Modified"))
+		if err != nil || modified.After(since) {
+			return nil
+		}
+	} else {
+		return nil
+	}
+
+	h := make(http.Header, len(notModifiedHeaders))
+	for _, name := range notModifiedHeaders {
+		if values, ok := header[name]; ok {
+			h[name] = values
+		}
+	}
+	return EmptyH(NotModifiedResponse.Status(), h).ToCacheable(item.Expires())
+}
+
+// Weak comparison (RFC 7232 3.2) of an If-None-Match value with an ETag
+func etagMatches(inm string, etag string) bool {
+	if len(etag) == 0 {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(inm, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// Sets a strong ETag, a hash of the body, on a response the upstream sent
+// without one
+func generateETag(res CachedResponse) {
+	n, ok := res.(*NormalResponse)
+	if ok == false || len(n.header.Get("Etag")) > 0 {
+		return
+	}
+	if n.header == nil {
+		n.header = make(http.Header, 1)
+	}
+	h := fnv.New128a()
+	h.Write(n.body)
+	n.header.Set("Etag", `"`+hex.EncodeToString(h.Sum(nil))+`"`)
+	n.generatedETag = true
+}
+
+// Whether the item's ETag was generated by garnish (see Cache.ETags), in
+// which case the upstream can't validate it
+func GeneratedETag(item CachedResponse) bool {
+	n, ok := unwrap(item).(*NormalResponse)
+	return ok && n.generatedETag
+}
+
+// A cached GET response served to a HEAD request: the same headers
+// (including the Content-Length) but no body
+type HeadResponse struct {
+	CachedResponse
+}
+
+func (r *HeadResponse) Write(runtime *Runtime, w io.Writer) {}
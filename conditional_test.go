@@ -0,0 +1,47 @@
+package garnish
+
+import (
+	. "github.com/karlseguin/expect"
+	"github.com/karlseguin/expect/build"
+	"gopkg.in/karlseguin/params.v2"
+	"net/http"
+	"testing"
+	"time"
+)
+
+type ConditionalTests struct{}
+
+func Test_Conditional(t *testing.T) {
+	Expectify(new(ConditionalTests), t)
+}
+
+func (_ ConditionalTests) MatchesIfNoneMatch() {
+	item := RespondH(200, http.Header{"Etag": []string{`"abc"`}, "Content-Type": []string{"text/plain"}}, "body").ToCacheable(time.Now().Add(time.Minute))
+	Expect(NotModified(NewRequest(build.Request().Header("If-None-Match", `"xyz"`).Request, &Route{}, params.New(0)), item)).To.Equal(nil)
+
+	res := NotModified(NewRequest(build.Request().Header("If-None-Match", `"xyz", W/"abc"`).Request, &Route{}, params.New(0)), item)
+	Expect(res.Status()).To.Equal(304)
+	Expect(res.Header().Get("Etag")).To.Equal(`"abc"`)
+	Expect(res.Header().Get("Content-Type")).To.Equal("")
+}
+
+func (_ ConditionalTests) MatchesIfModifiedSince() {
+	item := RespondH(200, http.Header{"Last-Modified": []string{"Mon, 02 Jan 2006 15:04:05 GMT"}}, "body").ToCacheable(time.Now().Add(time.Minute))
+	Expect(NotModified(NewRequest(build.Request().Header("If-Modified-Since", "Mon, 02 Jan 2006 15:04:05 GMT").Request, &Route{}, params.New(0)), item).Status()).To.Equal(304)
+	Expect(NotModified(NewRequest(build.Request().Header("If-Modified-Since", "Sun, 01 Jan 2006 15:04:05 GMT").Request, &Route{}, params.New(0)), item)).To.Equal(nil)
+	Expect(NotModified(NewRequest(build.Request().Header("If-Modified-Since", "invalid").Request, &Route{}, params.New(0)), item)).To.Equal(nil)
+}
+
+func (_ ConditionalTests) GeneratesAStableETag() {
+	a, b := Respond(200, "hello").ToCacheable(zero), Respond(200, "hello").ToCacheable(zero)
+	generateETag(a)
+	generateETag(b)
+	Expect(len(a.Header().Get("Etag"))).To.Equal(34)
+	Expect(a.Header().Get("Etag")).To.Equal(b.Header().Get("Etag"))
+	Expect(GeneratedETag(a)).To.Equal(true)
+
+	c := RespondH(200, http.Header{"Etag": []string{`"upstream"`}}, "hello").ToCacheable(zero)
+	generateETag(c)
+	Expect(c.Header().Get("Etag")).To.Equal(`"upstream"`)
+	Expect(GeneratedETag(c)).To.Equal(false)
+}
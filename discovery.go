@@ -0,0 +1,155 @@
+package garnish
+
+import (
+	"sort"
+	"time"
+)
+
+// An address found by a DiscoverySource
+type Endpoint struct {
+	Address string
+	Weight  int
+}
+
+// Where a Discoverer gets an upstream's addresses from
+type DiscoverySource interface {
+	// The source's current endpoints. changed is false when the source knows
+	// that nothing changed since the last call (say, an unmodified file)
+	Endpoints() (endpoints []Endpoint, changed bool, err error)
+}
+
+// Creates a transport for a newly discovered endpoint
+type TransportBuilder func(endpoint Endpoint) (*Transport, error)
+
+// Background worker which keeps an upstream's transports in sync with
+// a DiscoverySource
+type Discoverer struct {
+	Name string
+
+	// Optional. Checks each transport a refresh adds, an error keeps the
+	// upstream's current transports
+	Validate func(t *Transport) error
+
+	// Optional. Called once the upstream has been updated with the
+	// transports which were added and removed
+	Changed func(added []*Transport, removed []*Transport)
+
+	source   DiscoverySource
+	upstream *MultiTransportUpstream
+	build    TransportBuilder
+	interval time.Duration
+	drain    time.Duration
+	stop     chan struct{}
+}
+
+func NewDiscoverer(name string, upstream *MultiTransportUpstream, source DiscoverySource, build TransportBuilder, interval, drain time.Duration) *Discoverer {
+	return &Discoverer{
+		Name:     name,
+		source:   source,
+		upstream: upstream,
+		build:    build,
+		interval: interval,
+		drain:    drain,
+		stop:     make(chan struct{}),
+	}
+}
+
+// Run the worker
+func (d *Discoverer) Run() {
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-time.After(d.interval):
+			if err := d.Refresh(); err != nil {
+				Log.Errorf("upstream %s discovery: %v", d.Name, err)
+			}
+		}
+	}
+}
+
+func (d *Discoverer) Stop() {
+	close(d.stop)
+}
+
+// Fetches the endpoints and updates the upstream. Existing transports are
+// kept (along with their connections, health and ejection state) for
+// endpoints which haven't changed.
+func (d *Discoverer) Refresh() error {
+	endpoints, changed, err := d.source.Endpoints()
+	if err != nil {
+		return err
+	}
+	if changed == false {
+		return nil
+	}
+	if len(endpoints) == 0 {
+		// more likely a broken source than an upstream with no servers
+		Log.Warnf("upstream %s discovery found no endpoints, keeping the existing ones", d.Name)
+		return nil
+	}
+
+	current := d.upstream.Transports()
+	existing := make(map[Endpoint]*Transport, len(current))
+	for _, t := range current {
+		existing[Endpoint{t.Address, t.Weight}] = t
+	}
+	transports := make([]*Transport, 0, len(endpoints))
+	var added []*Transport
+	for _, e := range endpoints {
+		if t, ok := existing[e]; ok {
+			transports = append(transports, t)
+			delete(existing, e)
+			continue
+		}
+		t, err := d.build(e)
+		if err != nil {
+			return err
+		}
+		if d.Validate != nil {
+			if err := d.Validate(t); err != nil {
+				return err
+			}
+		}
+		transports = append(transports, t)
+		added = append(added, t)
+	}
+	if len(existing) == 0 && len(transports) == len(current) {
+		return nil
+	}
+	sort.Slice(transports, func(i, j int) bool { return transports[i].Address < transports[j].Address })
+	d.upstream.SetTransports(transports)
+	Log.Infof("upstream %s discovered %d transports (%d removed)", d.Name, len(transports), len(existing))
+	removed := make([]*Transport, 0, len(existing))
+	for _, t := range existing {
+		removed = append(removed, t)
+		go drain(t, d.drain)
+	}
+	if d.Changed != nil {
+		d.Changed(added, removed)
+	}
+	return nil
+}
+
+// Lets a removed transport finish its in-flight requests before closing
+// its connections
+func drain(t *Transport, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for t.Outstanding() > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 100)
+	}
+	if t.Transport != nil {
+		t.CloseIdleConnections()
+	}
+}
+
+// Replaces the upstream's transports. Requests already sent to a removed
+// transport aren't affected.
+func (u *MultiTransportUpstream) SetTransports(transports []*Transport) {
+	u.Lock()
+	u.transports = transports
+	u.Unlock()
+	if aware, ok := u.balancer.(TransportAware); ok {
+		aware.SetTransports(transports)
+	}
+}
@@ -0,0 +1,87 @@
+package garnish
+
+import (
+	"errors"
+	. "github.com/karlseguin/expect"
+	"testing"
+	"time"
+)
+
+type DiscoveryTests struct{}
+
+func Test_Discovery(t *testing.T) {
+	Log = NewFakeLogger()
+	Expectify(new(DiscoveryTests), t)
+}
+
+func (_ DiscoveryTests) KeepsExistingTransports() {
+	u := &MultiTransportUpstream{transports: testTransports("a", "b")}
+	a := u.transports[0]
+	source := &fakeSource{endpoints: []Endpoint{{"a", 0}, {"c", 0}}}
+	d := NewDiscoverer("test", u, source, testBuilder, time.Minute, time.Second)
+	Expect(d.Refresh()).To.Equal(nil)
+
+	transports := u.Transports()
+	Expect(len(transports)).To.Equal(2)
+	Expect(transports[0]).To.Equal(a)
+	Expect(transports[1].Address).To.Equal("c")
+}
+
+func (_ DiscoveryTests) IgnoresEmptyAndUnchangedSources() {
+	u := &MultiTransportUpstream{transports: testTransports("a")}
+	source := &fakeSource{}
+	d := NewDiscoverer("test", u, source, testBuilder, time.Minute, time.Second)
+	d.Refresh()
+	Expect(u.Transports()[0].Address).To.Equal("a")
+
+	source.endpoints, source.unchanged = []Endpoint{{"b", 0}}, true
+	d.Refresh()
+	Expect(u.Transports()[0].Address).To.Equal("a")
+}
+
+func (_ DiscoveryTests) UpdatesTheHashRing() {
+	b := NewHashBalancer(func(req *Request) string { return req.Id })
+	u := &MultiTransportUpstream{transports: testTransports("a"), balancer: b}
+	b.SetTransports(u.transports)
+	d := NewDiscoverer("test", u, &fakeSource{endpoints: []Endpoint{{"b", 0}}}, testBuilder, time.Minute, time.Second)
+	d.Refresh()
+	Expect(u.Transport(&Request{Id: "1"}).Address).To.Equal("b")
+}
+
+func (_ DiscoveryTests) ValidatesAndReportsChanges() {
+	u := &MultiTransportUpstream{transports: testTransports("a", "b")}
+	source := &fakeSource{endpoints: []Endpoint{{"a", 0}, {"bad", 0}}}
+	d := NewDiscoverer("test", u, source, testBuilder, time.Minute, time.Second)
+	d.Validate = func(t *Transport) error {
+		if t.Address == "bad" {
+			return errors.New("bad transport")
+		}
+		return nil
+	}
+	var added, removed []*Transport
+	d.Changed = func(a, r []*Transport) { added, removed = a, r }
+
+	Expect(d.Refresh().Error()).To.Equal("bad transport")
+	Expect(len(u.Transports())).To.Equal(2)
+	Expect(added).To.Equal(nil)
+
+	source.endpoints = []Endpoint{{"a", 0}, {"c", 0}}
+	Expect(d.Refresh()).To.Equal(nil)
+	Expect(len(added)).To.Equal(1)
+	Expect(added[0].Address).To.Equal("c")
+	Expect(len(removed)).To.Equal(1)
+	Expect(removed[0].Address).To.Equal("b")
+}
+
+type fakeSource struct {
+	endpoints []Endpoint
+	unchanged bool
+}
+
+func (s *fakeSource) Endpoints() ([]Endpoint, bool, error) {
+	return s.endpoints, s.unchanged == false, nil
+}
+
+func testBuilder(e Endpoint) (*Transport, error) {
+	return &Transport{Address: e.Address, Weight: e.Weight}, nil
+}
@@ -0,0 +1,158 @@
+package garnish
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Headers which only apply to a single connection and must not be passed
+// on by a proxy (RFC 7230 section 6.1)
+var HopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// Removes the hop-by-hop headers, including any listed in the
+// Connection header
+func RemoveHopHeaders(header http.Header) {
+	RemoveConnectionHeaders(header, header["Connection"])
+	for _, name := range HopHeaders {
+		header.Del(name)
+	}
+}
+
+// Removes the headers listed in connection, the Connection header of the
+// message header's values were copied from
+func RemoveConnectionHeaders(header http.Header, connection []string) {
+	for _, value := range connection {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); len(name) > 0 {
+				header.Del(name)
+			}
+		}
+	}
+}
+
+// Which forwarding headers are sent to upstreams. X-Forwarded-For is
+// always sent.
+type Forwarding struct {
+	// Send X-Forwarded-Proto, X-Forwarded-Host and X-Forwarded-Port
+	XForwarded bool
+
+	// Send the RFC 7239 Forwarded header
+	Forwarded bool
+
+	// Clients whose forwarding headers are kept (and appended to). The
+	// headers of any other client are replaced, so that they can't spoof
+	// their address
+	Trusted []*net.IPNet
+}
+
+var forwardingHeaders = []string{"X-Forwarded-For", "X-Forwarded-Proto", "X-Forwarded-Host", "X-Forwarded-Port", "Forwarded"}
+
+// Whether the forwarding headers sent by the client at remoteAddr
+// can be trusted
+func (f *Forwarding) Trusts(remoteAddr string) bool {
+	if f == nil || len(f.Trusted) == 0 {
+		return false
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range f.Trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Sets the forwarding headers of a request sent to an upstream. Safe to
+// call on a nil Forwarding, which only sends X-Forwarded-For
+func (f *Forwarding) Apply(in *Request, out http.Header) {
+	trusted := f.Trusts(in.RemoteAddr)
+	for _, name := range forwardingHeaders {
+		if values, ok := in.Header[name]; ok && trusted {
+			out[name] = values
+		} else {
+			delete(out, name)
+		}
+	}
+
+	clientIP, _, err := net.SplitHostPort(in.RemoteAddr)
+	if err == nil {
+		if prior, ok := out["X-Forwarded-For"]; ok {
+			out.Set("X-Forwarded-For", strings.Join(prior, ", ")+", "+clientIP)
+		} else {
+			out.Set("X-Forwarded-For", clientIP)
+		}
+	}
+	if f == nil || (f.XForwarded == false && f.Forwarded == false) {
+		return
+	}
+
+	proto, port := "http", "80"
+	if in.TLS != nil {
+		proto, port = "https", "443"
+	}
+	if addr, ok := in.Request.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		if _, p, err := net.SplitHostPort(addr.String()); err == nil {
+			port = p
+		}
+	}
+
+	if f.XForwarded {
+		// a trusted proxy's values describe the original request
+		if _, ok := out["X-Forwarded-Proto"]; ok == false {
+			out.Set("X-Forwarded-Proto", proto)
+		}
+		if _, ok := out["X-Forwarded-Host"]; ok == false {
+			out.Set("X-Forwarded-Host", in.Host)
+		}
+		if _, ok := out["X-Forwarded-Port"]; ok == false {
+			out.Set("X-Forwarded-Port", port)
+		}
+	}
+
+	if f.Forwarded {
+		element := "proto=" + proto + ";host=" + quoteForwarded(in.Host)
+		if err == nil {
+			element = "for=" + forwardedNode(clientIP) + ";" + element
+		}
+		if prior, ok := out["Forwarded"]; ok {
+			element = strings.Join(prior, ", ") + ", " + element
+		}
+		out.Set("Forwarded", element)
+	}
+}
+
+// IPv6 addresses are bracketed and quoted: for="[2001:db8::1]"
+func forwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return `"[` + ip + `]"`
+	}
+	return ip
+}
+
+// Values which aren't valid tokens (such as a host with a port) are quoted
+func quoteForwarded(value string) string {
+	for _, c := range value {
+		if c == ':' || c == '[' || c == ']' || c == ' ' || c == ',' || c == ';' || c == '"' {
+			return `"` + strings.Replace(value, `"`, `\"`, -1) + `"`
+		}
+	}
+	return value
+}
@@ -0,0 +1,70 @@
+package garnish
+
+import (
+	. "github.com/karlseguin/expect"
+	"github.com/karlseguin/expect/build"
+	"net"
+	"net/http"
+	"testing"
+)
+
+type ForwardingTests struct{}
+
+func Test_Forwarding(t *testing.T) {
+	Expectify(new(ForwardingTests), t)
+}
+
+func (_ ForwardingTests) RemovesHopHeaders() {
+	h := http.Header{
+		"Connection":        []string{"keep-alive, X-Secret"},
+		"Keep-Alive":        []string{"timeout=5"},
+		"Transfer-Encoding": []string{"chunked"},
+		"X-Secret":          []string{"1"},
+		"X-Other":           []string{"2"},
+	}
+	RemoveHopHeaders(h)
+	Expect(len(h)).To.Equal(1)
+	Expect(h.Get("X-Other")).To.Equal("2")
+}
+
+func (_ ForwardingTests) ReplacesUntrustedHeaders() {
+	f := &Forwarding{Forwarded: true, XForwarded: true, Trusted: trusted("10.0.0.0/8")}
+	req := &Request{Request: build.Request().Host("garnish.io").Header("X-Forwarded-For", "6.6.6.6").Header("X-Forwarded-Host", "evil.com").Header("Forwarded", "for=6.6.6.6").Request}
+	req.RemoteAddr = "1.2.3.4:9000"
+	out := http.Header{}
+	f.Apply(req, out)
+	Expect(out.Get("X-Forwarded-For")).To.Equal("1.2.3.4")
+	Expect(out.Get("X-Forwarded-Host")).To.Equal("garnish.io")
+	Expect(out.Get("X-Forwarded-Proto")).To.Equal("http")
+	Expect(out.Get("Forwarded")).To.Equal("for=1.2.3.4;proto=http;host=garnish.io")
+}
+
+func (_ ForwardingTests) AppendsToTrustedHeaders() {
+	f := &Forwarding{Forwarded: true, XForwarded: true, Trusted: trusted("10.0.0.0/8")}
+	req := &Request{Request: build.Request().Host("garnish.io").Header("X-Forwarded-For", "1.2.3.4").Header("X-Forwarded-Proto", "https").Header("Forwarded", "for=1.2.3.4").Request}
+	req.RemoteAddr = "10.0.0.2:9000"
+	out := http.Header{}
+	f.Apply(req, out)
+	Expect(out.Get("X-Forwarded-For")).To.Equal("1.2.3.4, 10.0.0.2")
+	Expect(out.Get("X-Forwarded-Proto")).To.Equal("https")
+	Expect(out.Get("Forwarded")).To.Equal("for=1.2.3.4, for=10.0.0.2;proto=http;host=garnish.io")
+}
+
+func (_ ForwardingTests) NilOnlySetsForwardedFor() {
+	var f *Forwarding
+	req := &Request{Request: build.Request().Header("X-Forwarded-For", "6.6.6.6").Request}
+	req.RemoteAddr = "[::1]:9000"
+	out := http.Header{}
+	f.Apply(req, out)
+	Expect(len(out)).To.Equal(1)
+	Expect(out.Get("X-Forwarded-For")).To.Equal("::1")
+	Expect(forwardedNode("::1")).To.Equal(`"[::1]"`)
+}
+
+func trusted(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, networks[i], _ = net.ParseCIDR(cidr)
+	}
+	return networks
+}
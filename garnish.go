@@ -19,6 +19,7 @@ func (g *Garnish) ServeHTTP(out http.ResponseWriter, request *http.Request) {
 func Start(runtime *Runtime) {
 	garnish = &Garnish{new(atomic.Value)}
 	garnish.Store(runtime)
+	runtime.Activate()
 
 	s := http.Server{
 		Handler:      garnish,
@@ -26,11 +27,17 @@ func Start(runtime *Runtime) {
 		ReadTimeout:  10 * time.Second,
 		WriteTimeout: 10 * time.Second,
 	}
+	for _, p := range runtime.TCPProxies {
+		if err := p.Listen(); err != nil {
+			panic(err)
+		}
+	}
 	Log.Infof("listening on %s", runtime.Address)
 	panic(s.ListenAndServe())
 }
 
 func Reload(runtime *Runtime) {
 	garnish.Load().(*Runtime).ReplaceWith(runtime)
+	runtime.Activate()
 	garnish.Store(runtime)
 }
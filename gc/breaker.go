@@ -0,0 +1,72 @@
+package gc
+
+import (
+	"gopkg.in/karlseguin/garnish.v1"
+	"time"
+)
+
+// Configuration for an upstream's circuit breaker
+type Breaker struct {
+	failureRate  float64
+	minRequests  int
+	window       time.Duration
+	open         time.Duration
+	halfOpen     int
+	perTransport bool
+}
+
+func NewBreaker() *Breaker {
+	return &Breaker{
+		failureRate: 0.5,
+		minRequests: 20,
+		window:      time.Second * 10,
+		open:        time.Second * 30,
+		halfOpen:    5,
+	}
+}
+
+// Open the circuit when more than rate (0 - 1) of the requests within
+// window fail. Only considered once minRequests have been seen within
+// the window
+// [0.5, 10 seconds, 20]
+func (b *Breaker) FailureRate(rate float64, window time.Duration, minRequests uint32) *Breaker {
+	b.failureRate, b.window, b.minRequests = rate, window, int(minRequests)
+	return b
+}
+
+// How long the circuit stays open before letting requests through again
+// [30 seconds]
+func (b *Breaker) Open(duration time.Duration) *Breaker {
+	b.open = duration
+	return b
+}
+
+// The number of requests let through once the circuit is half-open. If
+// they all succeed, the circuit closes. If any fail, it opens again.
+// [5]
+func (b *Breaker) HalfOpen(count uint32) *Breaker {
+	b.halfOpen = int(count)
+	return b
+}
+
+// Also give each of the upstream's transports its own circuit breaker
+// (with the same settings). Transports with an open circuit are skipped.
+func (b *Breaker) PerTransport() *Breaker {
+	b.perTransport = true
+	return b
+}
+
+func (b *Breaker) Build(name string) *garnish.CircuitBreaker {
+	halfOpen := b.halfOpen
+	if halfOpen < 1 {
+		halfOpen = 1
+	}
+	return &garnish.CircuitBreaker{
+		Name:        name,
+		FailureRate: b.failureRate,
+		MinRequests: b.minRequests,
+		Window:      b.window,
+		Open:        b.open,
+		HalfOpen:    halfOpen,
+	}
+}
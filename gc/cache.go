@@ -10,16 +10,19 @@ type Cache struct {
 	maxSize      int
 	grace        time.Duration
 	saint        bool
+	maxVariants  int
+	etags        bool
 	lookup       garnish.CacheKeyLookup
 	purgeHandler garnish.PurgeHandler
 }
 
 func NewCache() *Cache {
 	return &Cache{
-		maxSize: 104857600,
-		grace:   time.Minute,
-		lookup:  garnish.DefaultCacheKeyLookup,
-		saint:   true,
+		maxSize:     104857600,
+		grace:       time.Minute,
+		lookup:      garnish.DefaultCacheKeyLookup,
+		saint:       true,
+		maxVariants: 16,
 	}
 }
 
@@ -49,6 +52,22 @@ func (c *Cache) NoSaint() *Cache {
 	return c
 }
 
+// The most variants of a response which Varies (say, on Accept-Language)
+// to cache. Variants beyond this aren't cached. 0 for no limit
+// [16]
+func (c *Cache) MaxVariants(max int) *Cache {
+	c.maxVariants = max
+	return c
+}
+
+// Give cached responses which the upstream sent without an ETag a strong
+// one (a hash of the body) so that clients can revalidate them
+// [disabled]
+func (c *Cache) ETags() *Cache {
+	c.etags = true
+	return c
+}
+
 // The function used to generate the primary and secondary cache keys
 // This defaults use the URL for the primary key and the QueryString
 // for the secondary key
@@ -78,6 +97,8 @@ func (c *Cache) Build(runtime *garnish.Runtime) error {
 	runtime.Cache = garnish.NewCache()
 	runtime.Cache.Saint = c.saint
 	runtime.Cache.GraceTTL = c.grace
+	runtime.Cache.MaxVariants = c.maxVariants
+	runtime.Cache.ETags = c.etags
 	runtime.Cache.Storage = cache.New(c.maxSize)
 
 	if c.purgeHandler != nil {
@@ -93,6 +114,12 @@ func (c *Cache) Build(runtime *garnish.Runtime) error {
 		if route.Cache != nil && route.Cache.KeyLookup == nil {
 			route.Cache.KeyLookup = c.lookup
 		}
+		if route.Cache != nil && route.Split != nil {
+			route.Cache.KeyLookup = garnish.SplitCacheKeyLookup(route.Cache.KeyLookup)
+		}
+		if route.Cache != nil && route.ResponseURLs != nil {
+			route.Cache.KeyLookup = garnish.ResponseURLsCacheKeyLookup(route.Cache.KeyLookup)
+		}
 	}
 	return nil
 }
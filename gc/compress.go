@@ -0,0 +1,73 @@
+package gc
+
+import (
+	"compress/gzip"
+	"errors"
+	"gopkg.in/karlseguin/garnish.v1"
+	"gopkg.in/karlseguin/garnish.v1/middlewares"
+	"strings"
+)
+
+type Compress struct {
+	minSize int
+	types   []string
+	level   int
+	noCache bool
+}
+
+func NewCompress() *Compress {
+	return &Compress{
+		minSize: 1024,
+		level:   gzip.DefaultCompression,
+		types: []string{
+			"text/", "application/json", "application/javascript",
+			"application/xml", "image/svg+xml", "+json", "+xml",
+		},
+	}
+}
+
+// Responses with a known length smaller than this aren't compressed
+// [1024]
+func (c *Compress) MinSize(bytes int) *Compress {
+	c.minSize = bytes
+	return c
+}
+
+// The content types to compress. A type ending in / matches as a
+// prefix (text/), one starting with + as a suffix (+json)
+// [text/, application/json, application/javascript, application/xml, image/svg+xml, +json, +xml]
+func (c *Compress) Types(types ...string) *Compress {
+	c.types = types
+	return c
+}
+
+// The compression level, from 1 (fastest) to 9 (smallest)
+// [6]
+func (c *Compress) Level(level int) *Compress {
+	c.level = level
+	return c
+}
+
+// Don't store the compressed (or decompressed) variants of cached
+// responses, converting them on every hit instead
+// [variants are cached]
+func (c *Compress) NoCache() *Compress {
+	c.noCache = true
+	return c
+}
+
+func (c *Compress) Build(runtime *garnish.Runtime) (*middlewares.Compress, error) {
+	if c.level != gzip.DefaultCompression && (c.level < gzip.BestSpeed || c.level > gzip.BestCompression) {
+		return nil, errors.New("Compression level must be between 1 and 9")
+	}
+	types := make([]string, len(c.types))
+	for i, t := range c.types {
+		types[i] = strings.ToLower(t)
+	}
+	return &middlewares.Compress{
+		MinSize:       c.minSize,
+		Types:         types,
+		Level:         c.level,
+		CacheVariants: c.noCache == false && runtime.Cache != nil,
+	}, nil
+}
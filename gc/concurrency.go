@@ -0,0 +1,74 @@
+package gc
+
+import (
+	"gopkg.in/karlseguin/garnish.v1"
+	"time"
+)
+
+// Configuration for limiting the number of concurrent requests sent to
+// an upstream
+type Concurrency struct {
+	max         int
+	queue       int
+	maxWait     time.Duration
+	adaptive    bool
+	adaptiveMin int
+	adaptiveMax int
+	tolerance   float64
+}
+
+func NewConcurrency(max uint32) *Concurrency {
+	return &Concurrency{
+		max:       int(max),
+		queue:     int(max),
+		maxWait:   time.Second,
+		tolerance: 2,
+	}
+}
+
+// The number of requests which can wait for a slot, and how long they can
+// wait for. Requests which can't be queued, or which wait too long, get
+// the Overloaded response
+// [the concurrency limit, 1 second]
+func (c *Concurrency) Queue(size uint32, maxWait time.Duration) *Concurrency {
+	c.queue, c.maxWait = int(size), maxWait
+	return c
+}
+
+// Adjust the limit based on latency: grow it (up to max) while responses
+// are fast and shrink it (down to min) when they slow down or fail. The
+// configured limit is the starting point
+func (c *Concurrency) Adaptive(min, max uint32) *Concurrency {
+	c.adaptive, c.adaptiveMin, c.adaptiveMax = true, int(min), int(max)
+	return c
+}
+
+// With an adaptive limit, a response which takes longer than tolerance
+// times the lowest observed latency is considered a sign of congestion
+// [2]
+func (c *Concurrency) Tolerance(tolerance float64) *Concurrency {
+	c.tolerance = tolerance
+	return c
+}
+
+func (c *Concurrency) Build(name string) *garnish.ConcurrencyLimiter {
+	limiter := &garnish.ConcurrencyLimiter{
+		Name:    name,
+		Limit:   c.max,
+		Queue:   c.queue,
+		MaxWait: c.maxWait,
+	}
+	if c.adaptive {
+		min := c.adaptiveMin
+		if min < 1 {
+			min = 1
+		}
+		limiter.Adaptive = &garnish.AdaptiveLimit{
+			Min:       min,
+			Max:       c.adaptiveMax,
+			Tolerance: c.tolerance,
+			Backoff:   0.9,
+		}
+	}
+	return limiter
+}
@@ -2,6 +2,7 @@ package gc
 
 import (
 	"errors"
+	"fmt"
 	"github.com/BurntSushi/toml"
 	"gopkg.in/karlseguin/bytepool.v3"
 	"gopkg.in/karlseguin/dnscache.v1"
@@ -9,6 +10,8 @@ import (
 	"gopkg.in/karlseguin/garnish.v1/middlewares"
 	"gopkg.in/karlseguin/router.v1"
 	"gopkg.in/karlseguin/typed.v1"
+	"net"
+	"sort"
 	"time"
 )
 
@@ -23,18 +26,28 @@ const (
 
 // Configuration
 type Configuration struct {
-	address   string
-	notFound  garnish.Response
-	fatal     garnish.Response
-	stats     *Stats
-	router    *Router
-	upstreams *Upstreams
-	cache     *Cache
-	hydrate   *Hydrate
-	bytePool  poolConfiguration
-	dnsTTL    time.Duration
-	tweaker   garnish.RequestTweaker
-	before    map[MiddlewarePosition]struct {
+	address    string
+	notFound   garnish.Response
+	fatal      garnish.Response
+	timeout    garnish.Response
+	open       garnish.Response
+	overload   garnish.Response
+	tooLarge   garnish.Response
+	stats      *Stats
+	router     *Router
+	upstreams  *Upstreams
+	cache      *Cache
+	compress   *Compress
+	hydrate    *Hydrate
+	tcp        []*TCP
+	bytePool   poolConfiguration
+	dnsTTL     time.Duration
+	tweaker    garnish.RequestTweaker
+	trusted    []string
+	xforwarded bool
+	forwarded  bool
+	limits     garnish.Limits
+	before     map[MiddlewarePosition]struct {
 		name    string
 		handler garnish.Middleware
 	}
@@ -50,6 +63,10 @@ func Configure() *Configuration {
 	return &Configuration{
 		address:  ":8080",
 		fatal:    garnish.Empty(500),
+		timeout:  garnish.Empty(504),
+		open:     garnish.Empty(503),
+		overload: garnish.Empty(503),
+		tooLarge: garnish.Empty(413),
 		notFound: garnish.Empty(404),
 		dnsTTL:   time.Minute,
 		bytePool: poolConfiguration{65536, 64},
@@ -105,6 +122,28 @@ func (c *Configuration) Tweaker(tweaker garnish.RequestTweaker) *Configuration {
 	return c
 }
 
+// Networks (CIDRs, like 10.0.0.0/8) of proxies in front of garnish. Their
+// forwarding headers (X-Forwarded-*, Forwarded) are passed to upstreams
+// and appended to. Those sent by anyone else are replaced.
+// [none]
+func (c *Configuration) TrustedProxies(cidrs ...string) *Configuration {
+	c.trusted = cidrs
+	return c
+}
+
+// Send X-Forwarded-Proto, X-Forwarded-Host and X-Forwarded-Port to upstreams
+// (X-Forwarded-For is always sent)
+func (c *Configuration) XForwarded() *Configuration {
+	c.xforwarded = true
+	return c
+}
+
+// Send the RFC 7239 Forwarded header to upstreams
+func (c *Configuration) Forwarded() *Configuration {
+	c.forwarded = true
+	return c
+}
+
 // The response to return for a 404
 // [garnish.Empty(404)]
 func (c *Configuration) NotFound(response garnish.Response) *Configuration {
@@ -119,6 +158,65 @@ func (c *Configuration) Fatal(response garnish.Response) *Configuration {
 	return c
 }
 
+// The response to return when an upstream times out
+// [garnish.Empty(504)]
+func (c *Configuration) GatewayTimeout(response garnish.Response) *Configuration {
+	c.timeout = response
+	return c
+}
+
+// The response to return when an upstream's circuit breaker is open
+// The cache treats this response as an error (for saint mode) regardless
+// of its status
+// [garnish.Empty(503)]
+func (c *Configuration) CircuitOpen(response garnish.Response) *Configuration {
+	c.open = response
+	return c
+}
+
+// The response to return when an upstream's concurrency limit is reached
+// and the request couldn't be queued (or waited too long). Like CircuitOpen,
+// the cache treats this response as an error
+// [garnish.Empty(503)]
+func (c *Configuration) Overloaded(response garnish.Response) *Configuration {
+	c.overload = response
+	return c
+}
+
+// The response to return when a request's body is larger than its
+// route's MaxRequestBody
+// [garnish.Empty(413)]
+func (c *Configuration) PayloadTooLarge(response garnish.Response) *Configuration {
+	c.tooLarge = response
+	return c
+}
+
+// The largest request body, in bytes, to accept. Larger requests get a
+// PayloadTooLarge response. Overwritable on a per-route basis
+// [0 - no limit]
+func (c *Configuration) MaxRequestBody(bytes int64) *Configuration {
+	c.limits.MaxRequestBody = bytes
+	return c
+}
+
+// The largest response, in bytes, to cache. Larger responses are still
+// streamed to the client. Overwritable on a per-route basis
+// [0 - no limit]
+func (c *Configuration) MaxCacheableSize(bytes int64) *Configuration {
+	c.limits.MaxCacheable = bytes
+	return c
+}
+
+// The largest upstream response, in bytes, to accept. Larger responses are
+// treated as an error (a 500) when the upstream sends a Content-Length. When
+// it doesn't, the 200 has already been sent once the limit is reached, so
+// the body is cut off (and logged). Overwritable on a per-route basis
+// [0 - no limit]
+func (c *Configuration) MaxResponseSize(bytes int64) *Configuration {
+	c.limits.MaxResponse = bytes
+	return c
+}
+
 func (c *Configuration) Insert(position MiddlewarePosition, name string, handler garnish.Middleware) *Configuration {
 	c.before[position] = struct {
 		name    string
@@ -162,6 +260,21 @@ func (c *Configuration) Cache() *Cache {
 	return c.cache
 }
 
+// Enable and configure the compression middleware
+func (c *Configuration) Compress() *Compress {
+	if c.compress == nil {
+		c.compress = NewCompress()
+	}
+	return c.compress
+}
+
+// Configure a raw TCP listener which proxies to an upstream
+func (c *Configuration) TCP(name string) *TCP {
+	t := NewTCP(name)
+	c.tcp = append(c.tcp, t)
+	return t
+}
+
 // Configure your routes
 func (c *Configuration) Route(name string) *Route {
 	if c.router == nil {
@@ -174,12 +287,29 @@ func (c *Configuration) Route(name string) *Route {
 // used to start garnish
 func (c *Configuration) Build() (*garnish.Runtime, error) {
 	runtime := &garnish.Runtime{
-		Address:          c.address,
-		NotFoundResponse: c.notFound,
-		FatalResponse:    c.fatal,
-		Resolver:         dnscache.New(c.dnsTTL),
-		Router:           router.New(router.Configure()),
-		Executor:         garnish.WrapMiddleware("upst", middlewares.Upstream, nil),
+		Address:                 c.address,
+		NotFoundResponse:        c.notFound,
+		FatalResponse:           c.fatal,
+		TimeoutResponse:         c.timeout,
+		Resolver:                dnscache.New(c.dnsTTL),
+		Router:                  router.New(router.Configure()),
+		Executor:                garnish.WrapMiddleware("upst", middlewares.Upstream, nil),
+		CircuitOpenResponse:     c.open,
+		OverloadedResponse:      c.overload,
+		PayloadTooLargeResponse: c.tooLarge,
+		Tunnels:                 garnish.NewTunnels(),
+		Forwarding: &garnish.Forwarding{
+			XForwarded: c.xforwarded,
+			Forwarded:  c.forwarded,
+		},
+	}
+
+	for _, cidr := range c.trusted {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %v", cidr, err)
+		}
+		runtime.Forwarding.Trusted = append(runtime.Forwarding.Trusted, network)
 	}
 
 	if err := c.upstreams.Build(runtime, c.tweaker); err != nil {
@@ -190,9 +320,23 @@ func (c *Configuration) Build() (*garnish.Runtime, error) {
 		return nil, errors.New("Atleast one route must be configured")
 	}
 
+	for _, t := range c.tcp {
+		proxy, err := t.Build(runtime)
+		if err != nil {
+			return nil, err
+		}
+		runtime.TCPProxies = append(runtime.TCPProxies, proxy)
+	}
+
 	if err := c.router.Build(runtime); err != nil {
 		return nil, err
 	}
+	for _, route := range runtime.Routes {
+		route.Limits = inheritLimits(route.Limits, &c.limits)
+		if route.Cache != nil {
+			route.Cache.Limits = route.Limits
+		}
+	}
 
 	runtime.Executor = garnish.WrapMiddleware("dspt", middlewares.Dispatch, runtime.Executor)
 	if h, ok := c.before[BEFORE_DISPATCH]; ok {
@@ -214,8 +358,16 @@ func (c *Configuration) Build() (*garnish.Runtime, error) {
 		if err := c.cache.Build(runtime); err != nil {
 			return nil, err
 		}
+		c.router.headFromCache(runtime)
 		runtime.Executor = garnish.WrapMiddleware("cach", middlewares.Cache, runtime.Executor)
 	}
+	if c.compress != nil {
+		m, err := c.compress.Build(runtime)
+		if err != nil {
+			return nil, err
+		}
+		runtime.Executor = garnish.WrapMiddleware("cmpr", m.Handle, runtime.Executor)
+	}
 	if h, ok := c.before[BEFORE_CACHE]; ok {
 		runtime.Executor = garnish.WrapMiddleware(h.name, h.handler, runtime.Executor)
 	}
@@ -232,6 +384,40 @@ func (c *Configuration) Build() (*garnish.Runtime, error) {
 
 	runtime.BytePool = bytepool.New(c.bytePool.capacity, c.bytePool.count)
 	runtime.RegisterStats("bytepool", runtime.BytePool.Stats)
+
+	for _, p := range runtime.TCPProxies {
+		runtime.RegisterStats("tcp-"+p.Name, p.Stats)
+	}
+	runtime.RegisterStats("websocket", runtime.Tunnels.Stats)
+	for name, route := range runtime.Routes {
+		if route.Mirror != nil {
+			runtime.RegisterStats("mirror-"+name, route.Mirror.Stats)
+		}
+		if route.Limits != nil {
+			runtime.RegisterStats("limits-"+name, route.Limits.Stats)
+		}
+	}
+	for name, upstream := range runtime.Upstreams {
+		if l := upstream.Limiter(); l != nil {
+			runtime.RegisterStats("limiter-"+name, l.Stats)
+		}
+	}
+	for _, h := range runtime.HealthCheckers {
+		runtime.RegisterStats("health-"+h.Name, h.Stats)
+	}
+	for _, d := range runtime.Discoverers {
+		d.Changed = discoveredBreakerStats(runtime, d.Name)
+	}
+	for name, upstream := range runtime.Upstreams {
+		if b := upstream.Breaker(); b != nil {
+			runtime.RegisterStats("breaker-"+name, b.Stats)
+		}
+		for _, t := range upstream.Transports() {
+			if t.Breaker != nil {
+				runtime.RegisterStats("breaker-"+name+"-"+t.Address, t.Breaker.Stats)
+			}
+		}
+	}
 	return runtime, nil
 }
 
@@ -256,6 +442,24 @@ func LoadConfigTyped(t typed.Typed) (*Configuration, error) {
 	if t.BoolOr("debug", false) {
 		config.Debug()
 	}
+	if cidrs, ok := t.StringsIf("trustedproxies"); ok {
+		config.TrustedProxies(cidrs...)
+	}
+	if t.BoolOr("xforwarded", false) {
+		config.XForwarded()
+	}
+	if t.BoolOr("forwarded", false) {
+		config.Forwarded()
+	}
+	if n, ok := t.IntIf("maxrequestbody"); ok {
+		config.MaxRequestBody(int64(n))
+	}
+	if n, ok := t.IntIf("maxcacheable"); ok {
+		config.MaxCacheableSize(int64(n))
+	}
+	if n, ok := t.IntIf("maxresponse"); ok {
+		config.MaxResponseSize(int64(n))
+	}
 
 	for _, ut := range t.Objects("upstreams") {
 		upstream := config.Upstream(ut.String("name"))
@@ -265,14 +469,141 @@ func LoadConfigTyped(t typed.Typed) (*Configuration, error) {
 		if h, ok := ut.StringsIf("headers"); ok {
 			upstream.Headers(h...)
 		}
+		if ht, ok := ut.ObjectIf("responseheaders"); ok {
+			loadResponseHeaders(upstream.ResponseHeaders(), ht)
+		}
 		if t, ok := ut.StringIf("tweaker"); ok {
 			upstream.TweakerRef(t)
 		}
+		if b, ok := ut.StringIf("balancer"); ok {
+			upstream.Balancer(b)
+		}
+		if n, ok := ut.IntIf("connecttimeout"); ok {
+			upstream.ConnectTimeout(time.Millisecond * time.Duration(n))
+		}
+		if n, ok := ut.IntIf("headertimeout"); ok {
+			upstream.ResponseHeaderTimeout(time.Millisecond * time.Duration(n))
+		}
+		if n, ok := ut.IntIf("idletimeout"); ok {
+			upstream.IdleConnTimeout(time.Millisecond * time.Duration(n))
+		}
+		if n, ok := ut.IntIf("timeout"); ok {
+			upstream.Timeout(time.Millisecond * time.Duration(n))
+		}
 		for _, tt := range ut.Objects("transports") {
 			transport := upstream.Address(tt.String("address"))
 			if n, ok := tt.IntIf("keepalive"); ok {
 				transport.KeepAlive(uint32(n))
 			}
+			if n, ok := tt.IntIf("weight"); ok {
+				transport.Weight(uint32(n))
+			}
+			if st, ok := tt.ObjectIf("tls"); ok {
+				loadTLS(transport.TLS(), st)
+			}
+		}
+		if st, ok := ut.ObjectIf("tls"); ok {
+			loadTLS(upstream.TLS(), st)
+		}
+		if dt, ok := ut.ObjectIf("discovery"); ok {
+			var discovery *Discovery
+			if path, ok := dt.StringIf("file"); ok {
+				discovery = upstream.DiscoverFile(path)
+			} else {
+				discovery = upstream.DiscoverSRV(dt.String("srv"), dt.StringOr("scheme", "http"))
+			}
+			if n, ok := dt.IntIf("interval"); ok {
+				discovery.Interval(time.Second * time.Duration(n))
+			}
+			if n, ok := dt.IntIf("keepalive"); ok {
+				discovery.KeepAlive(uint32(n))
+			}
+			if n, ok := dt.IntIf("drain"); ok {
+				discovery.Drain(time.Second * time.Duration(n))
+			}
+		}
+		if ht, ok := ut.ObjectIf("health"); ok {
+			health := upstream.HealthCheck(ht.String("path"))
+			if n, ok := ht.IntIf("interval"); ok {
+				health.Interval(time.Second * time.Duration(n))
+			}
+			if n, ok := ht.IntIf("timeout"); ok {
+				health.Timeout(time.Millisecond * time.Duration(n))
+			}
+			if n, ok := ht.IntIf("status"); ok {
+				health.Status(n)
+			}
+			if n, ok := ht.IntIf("rise"); ok {
+				health.Rise(uint32(n))
+			}
+			if n, ok := ht.IntIf("fall"); ok {
+				health.Fall(uint32(n))
+			}
+		}
+		if rt, ok := ut.ObjectIf("retry"); ok {
+			retry := upstream.Retry(uint32(rt.IntOr("attempts", 2)))
+			if m, ok := rt.StringsIf("methods"); ok {
+				retry.Methods(m...)
+			}
+			if o, ok := rt.StringsIf("on"); ok {
+				retry.On(o...)
+			}
+			if n, ok := rt.IntIf("budget"); ok {
+				retry.Budget(uint32(n))
+			}
+		}
+		if bt, ok := ut.ObjectIf("breaker"); ok {
+			breaker := upstream.CircuitBreaker()
+			if r, ok := bt.FloatIf("failurerate"); ok {
+				breaker.FailureRate(r, time.Second*time.Duration(bt.IntOr("window", 10)), uint32(bt.IntOr("minrequests", 20)))
+			}
+			if n, ok := bt.IntIf("open"); ok {
+				breaker.Open(time.Second * time.Duration(n))
+			}
+			if n, ok := bt.IntIf("halfopen"); ok {
+				breaker.HalfOpen(uint32(n))
+			}
+			if bt.BoolOr("pertransport", false) {
+				breaker.PerTransport()
+			}
+		}
+		if ct, ok := ut.ObjectIf("concurrency"); ok {
+			max := ct.Int("max")
+			concurrency := upstream.MaxConcurrent(uint32(max))
+			concurrency.Queue(uint32(ct.IntOr("queue", max)), time.Millisecond*time.Duration(ct.IntOr("maxwait", 1000)))
+			if n, ok := ct.IntIf("adaptivemax"); ok {
+				concurrency.Adaptive(uint32(ct.IntOr("adaptivemin", 1)), uint32(n))
+			}
+			if t, ok := ct.FloatIf("tolerance"); ok {
+				concurrency.Tolerance(t)
+			}
+		}
+		if ot, ok := ut.ObjectIf("outliers"); ok {
+			outliers := upstream.Outliers()
+			if n, ok := ot.IntIf("consecutive"); ok {
+				outliers.Consecutive(uint32(n))
+			}
+			if r, ok := ot.FloatIf("errorrate"); ok {
+				outliers.ErrorRate(r, time.Second*time.Duration(ot.IntOr("window", 10)), uint32(ot.IntOr("minrequests", 10)))
+			}
+			if n, ok := ot.IntIf("ejection"); ok {
+				outliers.Ejection(time.Second*time.Duration(n), time.Second*time.Duration(ot.IntOr("maxejection", 300)))
+			}
+			if n, ok := ot.IntIf("maxejected"); ok {
+				outliers.MaxEjected(uint32(n))
+			}
+		}
+	}
+
+	for _, tt := range t.Objects("tcp") {
+		tcp := config.TCP(tt.String("name"))
+		tcp.Address(tt.String("address"))
+		tcp.Upstream(tt.String("upstream"))
+		if n, ok := tt.IntIf("idletimeout"); ok {
+			tcp.IdleTimeout(time.Second * time.Duration(n))
+		}
+		if n, ok := tt.IntIf("maxconnections"); ok {
+			tcp.MaxConnections(uint32(n))
 		}
 	}
 
@@ -285,12 +616,98 @@ func LoadConfigTyped(t typed.Typed) (*Configuration, error) {
 		if s, ok := rt.IntIf("slow"); ok {
 			route.Slow(time.Millisecond * time.Duration(s))
 		}
+		if t, ok := rt.IntIf("timeout"); ok {
+			route.Timeout(time.Millisecond * time.Duration(t))
+		}
+		if t, ok := rt.IntIf("connecttimeout"); ok {
+			route.ConnectTimeout(time.Millisecond * time.Duration(t))
+		}
+		if t, ok := rt.IntIf("headertimeout"); ok {
+			route.ResponseHeaderTimeout(time.Millisecond * time.Duration(t))
+		}
+		if n, ok := rt.IntIf("maxrequestbody"); ok {
+			route.MaxRequestBody(int64(n))
+		}
+		if n, ok := rt.IntIf("maxcacheable"); ok {
+			route.MaxCacheableSize(int64(n))
+		}
+		if n, ok := rt.IntIf("maxresponse"); ok {
+			route.MaxResponseSize(int64(n))
+		}
 		if c, ok := rt.IntIf("cache"); ok {
 			route.CacheTTL(time.Second * time.Duration(c))
 		}
 		if kl, ok := rt.StringIf("keylookup"); ok {
 			route.CacheKeyLookupRef(kl)
 		}
+		if ht, ok := rt.ObjectIf("responseheaders"); ok {
+			loadResponseHeaders(route.ResponseHeaders(), ht)
+		}
+		if rt.Bool("rewriteredirects") {
+			route.RewriteRedirects()
+		}
+		if rt.Bool("rewritecookies") {
+			route.RewriteCookies()
+		}
+		if st, ok := rt.ObjectIf("split"); ok {
+			split := route.Split()
+			for _, ut := range st.Objects("upstreams") {
+				split.Add(ut.String("name"), uint32(ut.IntOr("weight", 1)))
+			}
+			if c, ok := st.StringIf("stickycookie"); ok {
+				split.StickyCookie(c)
+			}
+			if h, ok := st.StringIf("stickyheader"); ok {
+				split.StickyHeader(h)
+			}
+			for _, ft := range st.Objects("force") {
+				split.Force(ft.String("header"), ft.String("value"), ft.String("upstream"))
+			}
+		}
+		if mt, ok := rt.ObjectIf("mirror"); ok {
+			percent, ok := mt.FloatIf("percent")
+			if ok == false {
+				percent = 100
+			}
+			mirror := route.Mirror(mt.String("upstream"), percent)
+			if mt.Bool("diff") {
+				mirror.Diff()
+			}
+			if n, ok := mt.IntIf("max"); ok {
+				mirror.MaxConcurrent(uint32(n))
+			}
+		}
+		if rt.Bool("websocket") {
+			route.WebSocket(time.Second * time.Duration(rt.IntOr("websocketidle", 300)))
+		}
+		if wt, ok := rt.ObjectIf("rewrite"); ok {
+			rewrite := route.Rewrite()
+			if p, ok := wt.StringIf("path"); ok {
+				rewrite.Path(p)
+			}
+			if p, ok := wt.StringIf("stripprefix"); ok {
+				rewrite.StripPrefix(p)
+			}
+			if p, ok := wt.StringIf("addprefix"); ok {
+				rewrite.AddPrefix(p)
+			}
+			if q, ok := wt.ObjectIf("setquery"); ok {
+				for k := range q {
+					rewrite.SetQuery(k, q.String(k))
+				}
+			}
+			if q, ok := wt.StringsIf("removequery"); ok {
+				rewrite.RemoveQuery(q...)
+			}
+			if q, ok := wt.ObjectIf("renamequery"); ok {
+				for k := range q {
+					rewrite.RenameQuery(k, q.String(k))
+				}
+			}
+			if wt.StringOr("cachekey", "original") == "rewritten" {
+				rewrite.CacheRewritten()
+			}
+		}
 	}
 
 	if ct, ok := t.ObjectIf("cache"); ok {
@@ -298,6 +715,117 @@ func LoadConfigTyped(t typed.Typed) (*Configuration, error) {
 		if s, ok := ct.IntIf("size"); ok {
 			cache.MaxSize(s)
 		}
+		if n, ok := ct.IntIf("maxvariants"); ok {
+			cache.MaxVariants(n)
+		}
+		if ct.BoolOr("etags", false) {
+			cache.ETags()
+		}
+	}
+
+	if ct, ok := t.ObjectIf("compress"); ok {
+		compress := config.Compress()
+		if n, ok := ct.IntIf("minsize"); ok {
+			compress.MinSize(n)
+		}
+		if types, ok := ct.StringsIf("types"); ok {
+			compress.Types(types...)
+		}
+		if n, ok := ct.IntIf("level"); ok {
+			compress.Level(n)
+		}
+		if ct.BoolOr("cache", true) == false {
+			compress.NoCache()
+		}
 	}
 	return config, nil
 }
+
+func loadTLS(t *TLS, st typed.Typed) {
+	if ca, ok := st.StringIf("ca"); ok {
+		t.CA(ca)
+	}
+	if cert, ok := st.StringIf("cert"); ok {
+		t.ClientCert(cert, st.String("key"))
+	}
+	if name, ok := st.StringIf("servername"); ok {
+		t.ServerName(name)
+	}
+	if version, ok := st.StringIf("minversion"); ok {
+		t.MinVersion(version)
+	}
+	if st.BoolOr("insecure", false) {
+		t.InsecureSkipVerify()
+	}
+}
+
+// Rules from a TOML table are applied as: remove, rename, set then append
+func loadResponseHeaders(headers *ResponseHeaders, t typed.Typed) {
+	if names, ok := t.StringsIf("remove"); ok {
+		headers.Remove(names...)
+	}
+	if rt, ok := t.ObjectIf("rename"); ok {
+		for _, name := range sortedKeys(rt) {
+			headers.Rename(name, rt.String(name))
+		}
+	}
+	if st, ok := t.ObjectIf("set"); ok {
+		for _, name := range sortedKeys(st) {
+			headers.Set(name, st.String(name))
+		}
+	}
+	if at, ok := t.ObjectIf("append"); ok {
+		for _, name := range sortedKeys(at) {
+			headers.Append(name, at.String(name))
+		}
+	}
+}
+
+func sortedKeys(t typed.Typed) []string {
+	keys := make([]string, 0, len(t))
+	for key := range t {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// A route's limits, with any it doesn't set taken from the global ones.
+// Negative route values disable the global limit. nil when there are none
+func inheritLimits(route *garnish.Limits, global *garnish.Limits) *garnish.Limits {
+	limits := &garnish.Limits{}
+	if route != nil {
+		limits = route
+	}
+	pick := func(value *int64, fallback int64) {
+		if *value == 0 {
+			*value = fallback
+		} else if *value < 0 {
+			*value = 0
+		}
+	}
+	pick(&limits.MaxRequestBody, global.MaxRequestBody)
+	pick(&limits.MaxCacheable, global.MaxCacheable)
+	pick(&limits.MaxResponse, global.MaxResponse)
+	if limits.MaxRequestBody == 0 && limits.MaxCacheable == 0 && limits.MaxResponse == 0 {
+		return nil
+	}
+	return limits
+}
+
+// Registers the breaker stats of transports added by discovery, and stops
+// reporting those of removed ones
+func discoveredBreakerStats(runtime *garnish.Runtime, name string) func(added, removed []*garnish.Transport) {
+	return func(added, removed []*garnish.Transport) {
+		for _, t := range removed {
+			if t.Breaker != nil {
+				runtime.UnregisterStats("breaker-" + name + "-" + t.Address)
+			}
+		}
+		for _, t := range added {
+			if t.Breaker != nil {
+				runtime.RegisterStats("breaker-"+name+"-"+t.Address, t.Breaker.Stats)
+			}
+		}
+	}
+}
@@ -1,8 +1,15 @@
 package gc
 
 import (
+	"crypto/tls"
 	. "github.com/karlseguin/expect"
+	"github.com/karlseguin/expect/build"
+	"gopkg.in/karlseguin/garnish.v1"
+	"gopkg.in/karlseguin/params.v2"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 type ConfigurationTests struct{}
@@ -25,7 +32,7 @@ func (_ ConfigurationTests) FailedBuildWithInvalidUpstreamAddress() {
 	c.Upstream("test2").Address("128.93.202.0")
 	r, err := c.Build()
 	Expect(r).To.Equal(nil)
-	Expect(err.Error()).To.Contain(`Upstream test2's address should begin with unix:/, http:// or https://`)
+	Expect(err.Error()).To.Contain(`Upstream test2's address should begin with unix:/, http://, https:// or tcp://`)
 }
 
 func (_ ConfigurationTests) FailedBuildWithoutRoute() {
@@ -35,3 +42,187 @@ func (_ ConfigurationTests) FailedBuildWithoutRoute() {
 	Expect(r).To.Equal(nil)
 	Expect(err.Error()).To.Contain("Atleast one route must be configured")
 }
+
+func (_ ConfigurationTests) FailedBuildWithNonTCPUpstream() {
+	c := Configure().DnsTTL(-1)
+	c.Upstream("test1").Address("http://openmymind.net/")
+	c.Route("home").Get("/").Upstream("test1")
+	c.TCP("redis").Address(":6379").Upstream("test1")
+	r, err := c.Build()
+	Expect(r).To.Equal(nil)
+	Expect(err.Error()).To.Contain(`tcp listener redis's upstream test1 has a non-tcp address: "http://openmymind.net/"`)
+}
+
+func (_ ConfigurationTests) FailedBuildWithInvalidTrustedProxy() {
+	c := Configure().DnsTTL(-1).TrustedProxies("10.0.0.0/8", "10.1")
+	c.Upstream("test1").Address("http://openmymind.net/")
+	c.Route("home").Get("/").Upstream("test1")
+	_, err := c.Build()
+	Expect(err.Error()).To.Contain(`invalid trusted proxy "10.1"`)
+}
+
+func (_ ConfigurationTests) FailedBuildWithUnknownMirror() {
+	c := Configure().DnsTTL(-1)
+	c.Upstream("test1").Address("http://openmymind.net/")
+	c.Route("home").Get("/").Upstream("test1").Mirror("test2", 10)
+	_, err := c.Build()
+	Expect(err.Error()).To.Contain(`Route "home" mirror: unknown upstream "test2"`)
+}
+
+func (_ ConfigurationTests) FailedBuildWithInvalidCompressionLevel() {
+	c := Configure().DnsTTL(-1)
+	c.Upstream("test1").Address("http://openmymind.net/")
+	c.Route("home").Get("/").Upstream("test1")
+	c.Compress().Level(12)
+	_, err := c.Build()
+	Expect(err.Error()).To.Equal("Compression level must be between 1 and 9")
+}
+
+func (_ ConfigurationTests) FailedBuildWithUpstreamAndSplit() {
+	c := Configure().DnsTTL(-1)
+	c.Upstream("test1").Address("http://openmymind.net/")
+	c.Route("home").Get("/").Upstream("test1").Split().Add("test1", 1)
+	_, err := c.Build()
+	Expect(err.Error()).To.Contain(`Route "home" has both an upstream and a split`)
+}
+
+func (_ ConfigurationTests) SplitsTrafficBetweenUpstreams() {
+	c := Configure().DnsTTL(-1)
+	c.Upstream("users").Address("http://openmymind.net/")
+	c.Upstream("canary").Address("http://openmymind.net/")
+	c.Route("home").Get("/").Split().Add("users", 95).Add("canary", 5).StickyHeader("X-User").Force("X-Canary", "1", "canary")
+	r, err := c.Build()
+	Expect(err).To.Equal(nil)
+	split := r.Routes["home"].Split
+	Expect(len(split.Targets)).To.Equal(2)
+	Expect(split.Targets[1].Weight).To.Equal(5)
+	Expect(split.Overrides[0].Target).To.Equal(split.Targets[1])
+}
+
+func (_ ConfigurationTests) RoutesRewritingResponseURLsCacheEachHost() {
+	c := Configure().DnsTTL(-1)
+	c.Cache()
+	c.Upstream("test1").Address("http://openmymind.net/")
+	c.Route("home").Get("/").Upstream("test1").RewriteRedirects()
+	r, err := c.Build()
+	Expect(err).To.Equal(nil)
+	req := garnish.NewRequest(build.Request().Host("garnish.io").Path("/").Request, nil, params.New(0))
+	_, secondary := r.Routes["home"].Cache.KeyLookup(req)
+	Expect(secondary).To.Equal("#http://garnish.io")
+}
+
+func (_ ConfigurationTests) GetRoutesAnswerHead() {
+	c := Configure().DnsTTL(-1)
+	c.Cache()
+	c.Upstream("test1").Address("http://openmymind.net/")
+	c.Route("home").Get("/users").Upstream("test1").CacheTTL(time.Minute)
+	c.Route("create").Post("/users").Upstream("test1")
+	r, err := c.Build()
+	Expect(err).To.Equal(nil)
+	_, action := r.Router.Lookup(build.Request().Method("HEAD").Path("/users").Request)
+	Expect(action.Name).To.Equal("home")
+	_, action = r.Router.Lookup(build.Request().Method("GET").Path("/users").Request)
+	Expect(action.Name).To.Equal("home")
+}
+
+func (_ ConfigurationTests) GetRoutesDontAnswerHeadWithoutACache() {
+	c := Configure().DnsTTL(-1)
+	c.Upstream("test1").Address("http://openmymind.net/")
+	c.Route("home").Get("/users").Upstream("test1")
+	r, err := c.Build()
+	Expect(err).To.Equal(nil)
+	_, action := r.Router.Lookup(build.Request().Method("HEAD").Path("/users").Request)
+	Expect(action == nil).To.Equal(true)
+}
+
+func (_ ConfigurationTests) HeadRoutesOverwriteTheCachedGet() {
+	c := Configure().DnsTTL(-1)
+	c.Cache()
+	c.Upstream("test1").Address("http://openmymind.net/")
+	c.Route("home").Get("/users").Upstream("test1").CacheTTL(time.Minute)
+	c.Route("probe").Head("/users").Upstream("test1")
+	r, err := c.Build()
+	Expect(err).To.Equal(nil)
+	_, action := r.Router.Lookup(build.Request().Method("HEAD").Path("/users").Request)
+	Expect(action.Name).To.Equal("probe")
+}
+
+func (_ ConfigurationTests) RoutesInheritTheGlobalLimits() {
+	c := Configure().DnsTTL(-1).MaxRequestBody(100).MaxCacheableSize(1000)
+	c.Upstream("test1").Address("http://openmymind.net/")
+	c.Route("home").Get("/").Upstream("test1").MaxRequestBody(10)
+	c.Route("upload").Post("/upload").Upstream("test1").MaxRequestBody(-1).MaxCacheableSize(-1)
+	r, err := c.Build()
+	Expect(err).To.Equal(nil)
+	home := r.Routes["home"]
+	Expect(home.Limits.MaxRequestBody).To.Equal(int64(10))
+	Expect(home.Limits.MaxCacheable).To.Equal(int64(1000))
+	Expect(home.Cache.Limits).To.Equal(home.Limits)
+	Expect(r.Routes["upload"].Limits == nil).To.Equal(true)
+}
+
+func (_ ConfigurationTests) FailedBuildWithInvalidTLS() {
+	c := Configure().DnsTTL(-1)
+	c.Upstream("test1").Address("https://openmymind.net/").TLS().MinVersion("2.0")
+	c.Route("home").Get("/").Upstream("test1")
+	_, err := c.Build()
+	Expect(err.Error()).To.Contain(`Upstream test1 has an invalid tls configuration: unknown tls version "2.0"`)
+
+	c = Configure().DnsTTL(-1)
+	c.Upstream("test1").Address("http://openmymind.net/").TLS().InsecureSkipVerify()
+	c.Route("home").Get("/").Upstream("test1")
+	_, err = c.Build()
+	Expect(err.Error()).To.Contain(`Upstream test1's tls settings require an https:// address`)
+}
+
+func (_ ConfigurationTests) TLSVerifiesTheHostname() {
+	c := Configure().DnsTTL(-1)
+	upstream := c.Upstream("test1")
+	upstream.TLS().MinVersion("1.3")
+	upstream.Address("https://openmymind.net:8443/")
+	upstream.Address("https://10.0.0.1/").TLS().ServerName("internal.openmymind.net")
+	c.Route("home").Get("/").Upstream("test1")
+	runtime, err := c.Build()
+	Expect(err).To.Equal(nil)
+	transports := runtime.Upstreams["test1"].Transports()
+	Expect(transports[0].TLSClientConfig.ServerName).To.Equal("openmymind.net")
+	Expect(transports[0].TLSClientConfig.MinVersion).To.Equal(uint16(tls.VersionTLS13))
+	Expect(transports[1].TLSClientConfig.ServerName).To.Equal("internal.openmymind.net")
+	Expect(transports[1].TLSClientConfig.MinVersion).To.Equal(uint16(tls.VersionTLS12))
+}
+
+func (_ ConfigurationTests) DiscoversTransportsFromAFile() {
+	path := filepath.Join(os.TempDir(), "garnish-discovery.json")
+	os.WriteFile(path, []byte(`{"transports": [{"address": "http://127.0.0.1:4005"}, {"address": "http://127.0.0.1:4006", "weight": 2}]}`), 0600)
+	defer os.Remove(path)
+
+	c := Configure().DnsTTL(-1)
+	c.Upstream("test1").DiscoverFile(path)
+	c.Route("home").Get("/").Upstream("test1")
+	runtime, err := c.Build()
+	Expect(err).To.Equal(nil)
+	transports := runtime.Upstreams["test1"].Transports()
+	Expect(len(transports)).To.Equal(2)
+	Expect(transports[1].Weight).To.Equal(2)
+	Expect(len(runtime.Discoverers)).To.Equal(1)
+}
+
+func (_ ConfigurationTests) DiscoveredTransportsOfATCPUpstreamMustBeTCP() {
+	path := filepath.Join(os.TempDir(), "garnish-tcp-discovery.json")
+	os.WriteFile(path, []byte(`{"transports": [{"address": "tcp://127.0.0.1:6379"}]}`), 0600)
+	defer os.Remove(path)
+
+	c := Configure().DnsTTL(-1)
+	c.Upstream("redis").DiscoverFile(path)
+	c.Route("home").Get("/").Upstream("redis")
+	c.TCP("redis").Address(":6379").Upstream("redis")
+	runtime, err := c.Build()
+	Expect(err).To.Equal(nil)
+
+	os.WriteFile(path, []byte(`{"transports": [{"address": "http://127.0.0.1:6380"}]}`), 0600)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(path, later, later)
+	err = runtime.Discoverers[0].Refresh()
+	Expect(err.Error()).To.Contain(`tcp listener redis's upstream redis has a non-tcp address: "http://127.0.0.1:6380"`)
+	Expect(runtime.Upstreams["redis"].Transports()[0].Address).To.Equal("tcp://127.0.0.1:6379")
+}
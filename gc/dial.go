@@ -0,0 +1,113 @@
+package gc
+
+import (
+	"context"
+	"fmt"
+	"gopkg.in/karlseguin/dnscache.v1"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// How long to wait on a connection attempt before also trying the
+// next address
+const fallbackDelay = time.Millisecond * 300
+
+// Dials hostnames through the dns cache. Every address (A and AAAA) is
+// used: connections are spread across them and, when one doesn't answer,
+// the next is tried
+type resolvingDialer struct {
+	dialer   *net.Dialer
+	resolver *dnscache.Resolver
+	next     uint64
+}
+
+func (d *resolvingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return d.dialer.DialContext(ctx, network, address)
+	}
+	ips, err := d.resolver.Fetch(host)
+	if err == nil && len(ips) == 0 {
+		err = fmt.Errorf("no addresses found")
+	}
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: fmt.Errorf("dns lookup of %s failed: %w", host, err)}
+	}
+
+	l := len(ips)
+	start := int(atomic.AddUint64(&d.next, 1) % uint64(l))
+	addresses := make([]string, l)
+	for i := 0; i < l; i++ {
+		addresses[i] = net.JoinHostPort(ips[(start+i)%l].String(), port)
+	}
+	return d.race(ctx, network, addresses)
+}
+
+// Starts dialing the first address. If it fails, or hasn't connected within
+// fallbackDelay, the next address is tried (without giving up on the first).
+// The first connection established wins.
+func (d *resolvingDialer) race(ctx context.Context, network string, addresses []string) (net.Conn, error) {
+	if len(addresses) == 1 {
+		return d.dialer.DialContext(ctx, network, addresses[0])
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, len(addresses))
+	next, pending := 0, 0
+	var first error
+	for {
+		if next < len(addresses) {
+			go func(address string) {
+				conn, err := d.dialer.DialContext(ctx, network, address)
+				results <- result{conn, err}
+			}(addresses[next])
+			next++
+			pending++
+		}
+
+		var timer *time.Timer
+		var fallback <-chan time.Time
+		if next < len(addresses) {
+			timer = time.NewTimer(fallbackDelay)
+			fallback = timer.C
+		}
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				if timer != nil {
+					timer.Stop()
+				}
+				// the losers are cancelled, close any that connected anyways
+				go func(pending int) {
+					for ; pending > 0; pending-- {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			if first == nil {
+				first = r.err
+			}
+			if pending == 0 && next == len(addresses) {
+				return nil, first
+			}
+		case <-fallback:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
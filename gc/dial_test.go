@@ -0,0 +1,42 @@
+package gc
+
+import (
+	"context"
+	. "github.com/karlseguin/expect"
+	"gopkg.in/karlseguin/dnscache.v1"
+	"net"
+	"testing"
+)
+
+type DialTests struct{}
+
+func Test_Dial(t *testing.T) {
+	Expectify(new(DialTests), t)
+}
+
+func (_ DialTests) TriesTheNextAddress() {
+	closed, _ := net.Listen("tcp", "127.0.0.1:0")
+	closed.Close()
+	open, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer open.Close()
+
+	d := &resolvingDialer{dialer: new(net.Dialer)}
+	conn, err := d.race(context.Background(), "tcp", []string{closed.Addr().String(), open.Addr().String()})
+	Expect(err).To.Equal(nil)
+	Expect(conn.RemoteAddr().String()).To.Equal(open.Addr().String())
+	conn.Close()
+}
+
+func (_ DialTests) FailsWhenNoAddressConnects() {
+	closed, _ := net.Listen("tcp", "127.0.0.1:0")
+	closed.Close()
+	d := &resolvingDialer{dialer: new(net.Dialer)}
+	_, err := d.race(context.Background(), "tcp", []string{closed.Addr().String(), closed.Addr().String()})
+	Expect(err == nil).To.Equal(false)
+}
+
+func (_ DialTests) ReportsDnsFailures() {
+	d := &resolvingDialer{dialer: new(net.Dialer), resolver: dnscache.New(-1)}
+	_, err := d.DialContext(context.Background(), "tcp", "garnish.invalid:80")
+	Expect(err.Error()).To.Contain("dial tcp: dns lookup of garnish.invalid failed")
+}
@@ -0,0 +1,126 @@
+package gc
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/karlseguin/garnish.v1"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Configuration for discovering an upstream's addresses
+type Discovery struct {
+	source    garnish.DiscoverySource
+	interval  time.Duration
+	keepalive int
+	drain     time.Duration
+}
+
+func NewDiscovery(source garnish.DiscoverySource, interval time.Duration) *Discovery {
+	return &Discovery{
+		source:    source,
+		interval:  interval,
+		keepalive: 16,
+		drain:     time.Second * 30,
+	}
+}
+
+// How often to check the source for changes
+// [5 seconds for files, 30 seconds for SRV records]
+func (d *Discovery) Interval(interval time.Duration) *Discovery {
+	d.interval = interval
+	return d
+}
+
+// The number of connections to keep alive for each discovered address
+// [16]
+func (d *Discovery) KeepAlive(count uint32) *Discovery {
+	d.keepalive = int(count)
+	return d
+}
+
+// How long a removed address has to finish its in-flight requests before
+// its connections are closed
+// [30 seconds]
+func (d *Discovery) Drain(timeout time.Duration) *Discovery {
+	d.drain = timeout
+	return d
+}
+
+// Reads addresses from a json or toml file, using the same transports
+// (address and weight) structure as the main configuration file. The file
+// is only re-read when its modification time changes.
+type FileSource struct {
+	path     string
+	modified time.Time
+}
+
+func NewFileSource(path string) *FileSource {
+	return &FileSource{path: path}
+}
+
+func (s *FileSource) Endpoints() ([]garnish.Endpoint, bool, error) {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return nil, false, err
+	}
+	if info.ModTime().Equal(s.modified) {
+		return nil, false, nil
+	}
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var file struct {
+		Transports []struct {
+			Address string `json:"address" toml:"address"`
+			Weight  int    `json:"weight" toml:"weight"`
+		} `json:"transports" toml:"transports"`
+	}
+	if strings.ToLower(filepath.Ext(s.path)) == ".json" {
+		err = json.Unmarshal(data, &file)
+	} else {
+		_, err = toml.Decode(string(data), &file)
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("%s: %v", s.path, err)
+	}
+	endpoints := make([]garnish.Endpoint, len(file.Transports))
+	for i, t := range file.Transports {
+		endpoints[i] = garnish.Endpoint{Address: t.Address, Weight: t.Weight}
+	}
+	s.modified = info.ModTime()
+	return endpoints, true, nil
+}
+
+// Looks up addresses from a DNS SRV record, such as _http._tcp.users.internal
+type SRVSource struct {
+	name   string
+	scheme string
+}
+
+func NewSRVSource(name, scheme string) *SRVSource {
+	return &SRVSource{name: name, scheme: scheme}
+}
+
+func (s *SRVSource) Endpoints() ([]garnish.Endpoint, bool, error) {
+	_, records, err := net.LookupSRV("", "", s.name)
+	if err != nil {
+		return nil, false, err
+	}
+	endpoints := make([]garnish.Endpoint, len(records))
+	for i, r := range records {
+		host := strings.TrimSuffix(r.Target, ".")
+		endpoints[i] = garnish.Endpoint{
+			Address: s.scheme + "://" + net.JoinHostPort(host, strconv.Itoa(int(r.Port))),
+			Weight:  int(r.Weight),
+		}
+	}
+	return endpoints, true, nil
+}
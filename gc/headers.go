@@ -0,0 +1,52 @@
+package gc
+
+import (
+	"gopkg.in/karlseguin/garnish.v1"
+)
+
+// Changes made to the headers of responses sent to the client. Rules are
+// applied in the order they're added. Values can contain placeholders:
+// {request.id}, {request.method}, {request.path}, {route.name} and
+// {cache.status}
+type ResponseHeaders struct {
+	rules garnish.HeaderRules
+}
+
+func NewResponseHeaders() *ResponseHeaders {
+	return &ResponseHeaders{}
+}
+
+// Set the header, replacing any existing values
+func (h *ResponseHeaders) Set(name, value string) *ResponseHeaders {
+	return h.add(garnish.SetHeader, name, value)
+}
+
+// Add a value to the header, keeping existing values
+func (h *ResponseHeaders) Append(name, value string) *ResponseHeaders {
+	return h.add(garnish.AppendHeader, name, value)
+}
+
+// Remove the headers
+func (h *ResponseHeaders) Remove(names ...string) *ResponseHeaders {
+	for _, name := range names {
+		h.add(garnish.RemoveHeader, name, "")
+	}
+	return h
+}
+
+// Rename the header
+func (h *ResponseHeaders) Rename(from, to string) *ResponseHeaders {
+	return h.add(garnish.RenameHeader, from, to)
+}
+
+func (h *ResponseHeaders) add(op garnish.HeaderOp, name, value string) *ResponseHeaders {
+	h.rules = append(h.rules, garnish.HeaderRule{Op: op, Name: name, Value: value})
+	return h
+}
+
+func (h *ResponseHeaders) Build() garnish.HeaderRules {
+	if h == nil {
+		return nil
+	}
+	return h.rules
+}
@@ -0,0 +1,75 @@
+package gc
+
+import (
+	"gopkg.in/karlseguin/garnish.v1"
+	"time"
+)
+
+// Configuration for an upstream's active health check
+type HealthCheck struct {
+	path     string
+	interval time.Duration
+	timeout  time.Duration
+	status   int
+	rise     int
+	fall     int
+}
+
+func NewHealthCheck(path string) *HealthCheck {
+	return &HealthCheck{
+		path:     path,
+		interval: time.Second * 10,
+		timeout:  time.Second * 2,
+		status:   200,
+		rise:     2,
+		fall:     3,
+	}
+}
+
+// How often to probe each transport
+// [10 seconds]
+func (h *HealthCheck) Interval(interval time.Duration) *HealthCheck {
+	h.interval = interval
+	return h
+}
+
+// How long to wait for a probe's response before considering it failed
+// [2 seconds]
+func (h *HealthCheck) Timeout(timeout time.Duration) *HealthCheck {
+	h.timeout = timeout
+	return h
+}
+
+// The status code a healthy transport replies with
+// [200]
+func (h *HealthCheck) Status(status int) *HealthCheck {
+	h.status = status
+	return h
+}
+
+// The number of consecutive successful probes before an unhealthy
+// transport is considered healthy again
+// [2]
+func (h *HealthCheck) Rise(count uint32) *HealthCheck {
+	h.rise = int(count)
+	return h
+}
+
+// The number of consecutive failed probes before a healthy transport
+// is considered unhealthy
+// [3]
+func (h *HealthCheck) Fall(count uint32) *HealthCheck {
+	h.fall = int(count)
+	return h
+}
+
+func (h *HealthCheck) Build() *garnish.HealthCheck {
+	return &garnish.HealthCheck{
+		Path:     h.path,
+		Interval: h.interval,
+		Timeout:  h.timeout,
+		Status:   h.status,
+		Rise:     h.rise,
+		Fall:     h.fall,
+	}
+}
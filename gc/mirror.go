@@ -0,0 +1,55 @@
+package gc
+
+import (
+	"fmt"
+	"gopkg.in/karlseguin/garnish.v1"
+)
+
+// Configuration for sending a copy of a route's requests to another upstream
+type Mirror struct {
+	upstream string
+	percent  float64
+	diff     bool
+	max      int64
+}
+
+func NewMirror(upstream string, percent float64) *Mirror {
+	return &Mirror{
+		upstream: upstream,
+		percent:  percent,
+		max:      32,
+	}
+}
+
+// Compare the mirror's responses (status and body) to the primary's and
+// log any difference. Primary bodies up to 1MB are read before being
+// sent to the client
+func (m *Mirror) Diff() *Mirror {
+	m.diff = true
+	return m
+}
+
+// The maximum number of mirrored requests in flight. Requests beyond this
+// aren't mirrored
+// [32]
+func (m *Mirror) MaxConcurrent(max uint32) *Mirror {
+	m.max = int64(max)
+	return m
+}
+
+func (m *Mirror) Build(runtime *garnish.Runtime) (*garnish.Mirror, error) {
+	upstream, exists := runtime.Upstreams[m.upstream]
+	if exists == false {
+		return nil, fmt.Errorf("unknown upstream %q", m.upstream)
+	}
+	if m.percent <= 0 || m.percent > 100 {
+		return nil, fmt.Errorf("percent must be between 0 and 100, got %v", m.percent)
+	}
+	return &garnish.Mirror{
+		Name:     m.upstream,
+		Upstream: upstream,
+		Percent:  m.percent,
+		Diff:     m.diff,
+		Max:      m.max,
+	}, nil
+}
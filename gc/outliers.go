@@ -0,0 +1,75 @@
+package gc
+
+import (
+	"gopkg.in/karlseguin/garnish.v1"
+	"time"
+)
+
+// Configuration for an upstream's passive outlier ejection
+type Outliers struct {
+	consecutive int
+	errorRate   float64
+	window      time.Duration
+	minRequests int
+	ejection    time.Duration
+	maxEjection time.Duration
+	maxEjected  int
+}
+
+func NewOutliers() *Outliers {
+	return &Outliers{
+		consecutive: 5,
+		window:      time.Second * 10,
+		minRequests: 10,
+		ejection:    time.Second * 30,
+		maxEjection: time.Minute * 5,
+		maxEjected:  50,
+	}
+}
+
+// Eject a transport after this many consecutive failures. 0 disables
+// [5]
+func (o *Outliers) Consecutive(count uint32) *Outliers {
+	o.consecutive = int(count)
+	return o
+}
+
+// Eject a transport when more than rate (0 - 1) of its requests within
+// window fail. Only considered once the transport has seen minRequests
+// within the window.
+// [disabled]
+func (o *Outliers) ErrorRate(rate float64, window time.Duration, minRequests uint32) *Outliers {
+	o.errorRate, o.window, o.minRequests = rate, window, int(minRequests)
+	return o
+}
+
+// How long a transport is ejected for. The duration doubles on each
+// repeat offence, up to max.
+// [30 seconds, 5 minutes]
+func (o *Outliers) Ejection(duration time.Duration, max time.Duration) *Outliers {
+	o.ejection, o.maxEjection = duration, max
+	return o
+}
+
+// The maximum percentage of transports which can be ejected at once
+// [50]
+func (o *Outliers) MaxEjected(percent uint32) *Outliers {
+	o.maxEjected = int(percent)
+	return o
+}
+
+func (o *Outliers) Build() *garnish.OutlierDetection {
+	maxEjection := o.maxEjection
+	if maxEjection < o.ejection {
+		maxEjection = o.ejection
+	}
+	return &garnish.OutlierDetection{
+		Consecutive:       o.consecutive,
+		ErrorRate:         o.errorRate,
+		Window:            o.window,
+		MinRequests:       o.minRequests,
+		Ejection:          o.ejection,
+		MaxEjection:       maxEjection,
+		MaxEjectedPercent: o.maxEjected,
+	}
+}
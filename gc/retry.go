@@ -0,0 +1,77 @@
+package gc
+
+import (
+	"fmt"
+	"gopkg.in/karlseguin/garnish.v1"
+	"strconv"
+	"strings"
+)
+
+// Configuration for retrying failed upstream requests
+type Retry struct {
+	attempts   int
+	methods    []string
+	conditions []string
+	budget     int
+}
+
+func NewRetry(attempts uint32) *Retry {
+	return &Retry{
+		attempts:   int(attempts),
+		methods:    garnish.DefaultRetryMethods,
+		conditions: garnish.DefaultRetryConditions,
+		budget:     20,
+	}
+}
+
+// The methods which can be retried. Requests with a body are buffered
+// so that they can be replayed.
+// [GET, HEAD, OPTIONS]
+func (r *Retry) Methods(methods ...string) *Retry {
+	r.methods = methods
+	return r
+}
+
+// The conditions which trigger a retry: "connect" (the connection couldn't
+// be established), "reset" (the connection was reset or closed before a
+// response was received) and/or a response status code, such as "503"
+// [connect, reset, 502, 503, 504]
+func (r *Retry) On(conditions ...string) *Retry {
+	r.conditions = conditions
+	return r
+}
+
+// The maximum percentage of requests which can be retries. Protects
+// a struggling upstream from being hammered by retries. 0 for no limit
+// [20]
+func (r *Retry) Budget(percent uint32) *Retry {
+	r.budget = int(percent)
+	return r
+}
+
+func (r *Retry) Build() (*garnish.RetryPolicy, error) {
+	policy := &garnish.RetryPolicy{
+		Attempts: r.attempts,
+		Methods:  make(map[string]bool, len(r.methods)),
+		Statuses: make(map[int]bool),
+		Budget:   r.budget,
+	}
+	for _, method := range r.methods {
+		policy.Methods[strings.ToUpper(method)] = true
+	}
+	for _, condition := range r.conditions {
+		switch condition {
+		case garnish.RETRY_CONNECT:
+			policy.Connect = true
+		case garnish.RETRY_RESET:
+			policy.Reset = true
+		default:
+			status, err := strconv.Atoi(condition)
+			if err != nil {
+				return nil, fmt.Errorf("unknown retry condition %q", condition)
+			}
+			policy.Statuses[status] = true
+		}
+	}
+	return policy, nil
+}
@@ -0,0 +1,84 @@
+package gc
+
+import (
+	"gopkg.in/karlseguin/garnish.v1"
+)
+
+// Rules for changing a route's URL before it's sent to the upstream
+type Rewrite struct {
+	path        string
+	stripPrefix string
+	addPrefix   string
+	setQuery    map[string]string
+	removeQuery []string
+	renameQuery map[string]string
+	cacheKey    bool
+}
+
+func NewRewrite() *Rewrite {
+	return &Rewrite{}
+}
+
+// Rebuild the path from a template. :name segments are replaced with the
+// route's params and * with what the route's wildcard matched:
+// route /api/users/:id  =>  Path("/v2/user/:id")
+func (r *Rewrite) Path(template string) *Rewrite {
+	r.path = template
+	return r
+}
+
+// Remove prefix from the start of the path, when it matches whole segments
+func (r *Rewrite) StripPrefix(prefix string) *Rewrite {
+	r.stripPrefix = prefix
+	return r
+}
+
+// Add prefix to the start of the path (after StripPrefix)
+func (r *Rewrite) AddPrefix(prefix string) *Rewrite {
+	r.addPrefix = prefix
+	return r
+}
+
+// Set a query parameter. A value beginning with : is replaced by the
+// route's param of that name
+func (r *Rewrite) SetQuery(key, value string) *Rewrite {
+	if r.setQuery == nil {
+		r.setQuery = make(map[string]string)
+	}
+	r.setQuery[key] = value
+	return r
+}
+
+// Remove query parameters
+func (r *Rewrite) RemoveQuery(keys ...string) *Rewrite {
+	r.removeQuery = append(r.removeQuery, keys...)
+	return r
+}
+
+// Rename a query parameter
+func (r *Rewrite) RenameQuery(from, to string) *Rewrite {
+	if r.renameQuery == nil {
+		r.renameQuery = make(map[string]string)
+	}
+	r.renameQuery[from] = to
+	return r
+}
+
+// Cache based on the rewritten URL rather than the one the client sent
+// (ignored when the route has its own CacheKeyLookup)
+func (r *Rewrite) CacheRewritten() *Rewrite {
+	r.cacheKey = true
+	return r
+}
+
+func (r *Rewrite) Build(pattern string) *garnish.Rewrite {
+	return &garnish.Rewrite{
+		Pattern:     pattern,
+		Path:        r.path,
+		StripPrefix: r.stripPrefix,
+		AddPrefix:   r.addPrefix,
+		SetQuery:    r.setQuery,
+		RemoveQuery: r.removeQuery,
+		RenameQuery: r.renameQuery,
+	}
+}
@@ -48,6 +48,23 @@ func (r *Router) Build(runtime *garnish.Runtime) error {
 	return nil
 }
 
+// Registers a HEAD for each GET route, so that HEAD requests are answered
+// from the cached GET. Only called when the cache is configured. Paths with
+// their own HEAD route are left alone
+func (r *Router) headFromCache(runtime *garnish.Runtime) {
+	heads := make(map[string]bool)
+	for _, route := range r.routes {
+		if route.method == "HEAD" {
+			heads[route.path] = true
+		}
+	}
+	for name, route := range r.routes {
+		if route.method == "GET" && heads[route.path] == false {
+			runtime.Router.AddNamed(name, "HEAD", route.path, nil)
+		}
+	}
+}
+
 type Route struct {
 	name              string
 	path              string
@@ -56,9 +73,20 @@ type Route struct {
 	stopHandler       garnish.Handler
 	flowHandler       garnish.Middleware
 	slow              time.Duration
+	timeout           time.Duration
+	connectTimeout    time.Duration
+	headerTimeout     time.Duration
 	cacheTTL          time.Duration
 	cacheKeyLookup    garnish.CacheKeyLookup
 	cacheKeyLookupRef string
+	rewrite           *Rewrite
+	websocket         bool
+	websocketIdle     time.Duration
+	mirror            *Mirror
+	split             *Split
+	responseHeaders   *ResponseHeaders
+	responseURLs      garnish.ResponseURLs
+	limits            garnish.Limits
 }
 
 // Specify the name of the upstream.
@@ -135,6 +163,27 @@ func (r *Route) Slow(max time.Duration) *Route {
 	return r
 }
 
+// The deadline for the entire upstream request, including reading the body
+// (overwrites the upstream's Timeout)
+func (r *Route) Timeout(timeout time.Duration) *Route {
+	r.timeout = timeout
+	return r
+}
+
+// The time to wait for a connection to the upstream to be established
+// (overwrites the upstream's ConnectTimeout)
+func (r *Route) ConnectTimeout(timeout time.Duration) *Route {
+	r.connectTimeout = timeout
+	return r
+}
+
+// The time to wait for the upstream's response headers once the request
+// has been written (overwrites the upstream's ResponseHeaderTimeout)
+func (r *Route) ResponseHeaderTimeout(timeout time.Duration) *Route {
+	r.headerTimeout = timeout
+	return r
+}
+
 // The amount of time to cachet his request. If not specified, the
 // Cache-Control header will be used (including not caching private).
 // A value < 0 disables the cache for this route
@@ -166,6 +215,80 @@ func (r *Route) CacheKeyLookupRef(route string) *Route {
 	return r
 }
 
+// Change the URL before it's sent to the upstream
+func (r *Route) Rewrite() *Rewrite {
+	r.rewrite = NewRewrite()
+	return r.rewrite
+}
+
+// Proxy Upgrade (websocket) requests. Connections which haven't seen any
+// traffic for idle are closed, 0 disables the timeout
+func (r *Route) WebSocket(idle time.Duration) *Route {
+	r.websocket, r.websocketIdle = true, idle
+	return r
+}
+
+// Send a copy of percent (0-100) of this route's requests to another
+// upstream. The copy's response is discarded
+func (r *Route) Mirror(upstream string, percent float64) *Mirror {
+	r.mirror = NewMirror(upstream, percent)
+	return r.mirror
+}
+
+// Split traffic between several upstreams by weight (instead of Upstream)
+func (r *Route) Split() *Split {
+	r.split = NewSplit()
+	return r.split
+}
+
+// Change the headers of responses sent to the client (applied after
+// the upstream's)
+func (r *Route) ResponseHeaders() *ResponseHeaders {
+	if r.responseHeaders == nil {
+		r.responseHeaders = NewResponseHeaders()
+	}
+	return r.responseHeaders
+}
+
+// Map the upstream's address, and the route's rewritten path, in the
+// Location, Content-Location and Refresh headers back to the client's
+func (r *Route) RewriteRedirects() *Route {
+	r.responseURLs.Redirects = true
+	return r
+}
+
+// Map the upstream's host, and the route's rewritten path, in the Domain and
+// Path attributes of cookies back to the client's
+func (r *Route) RewriteCookies() *Route {
+	r.responseURLs.Cookies = true
+	return r
+}
+
+// The largest request body, in bytes, to accept. A negative value
+// removes the global limit for this route
+// (overwrites the global MaxRequestBody)
+func (r *Route) MaxRequestBody(bytes int64) *Route {
+	r.limits.MaxRequestBody = bytes
+	return r
+}
+
+// The largest response, in bytes, to cache. A negative value removes the
+// global limit for this route
+// (overwrites the global MaxCacheableSize)
+func (r *Route) MaxCacheableSize(bytes int64) *Route {
+	r.limits.MaxCacheable = bytes
+	return r
+}
+
+// The largest upstream response, in bytes, to accept. Responses without a
+// Content-Length are cut off, after their 200, rather than rejected. A
+// negative value removes the global limit for this route
+// (overwrites the global MaxResponseSize)
+func (r *Route) MaxResponseSize(bytes int64) *Route {
+	r.limits.MaxResponse = bytes
+	return r
+}
+
 // Specify the handler function
 func (r *Route) Handler(handler garnish.Handler) *Route {
 	r.stopHandler = handler
@@ -183,6 +306,20 @@ func (r *Route) Build(runtime *garnish.Runtime) (*garnish.Route, error) {
 		Name:        r.name,
 		StopHandler: r.stopHandler,
 		FlowHandler: r.flowHandler,
+		Timeout:     r.timeout,
+
+		ConnectTimeout: r.connectTimeout,
+		HeaderTimeout:  r.headerTimeout,
+
+		WebSocket:     r.websocket,
+		WebSocketIdle: r.websocketIdle,
+
+		ResponseHeaders: r.responseHeaders.Build(),
+	}
+
+	if r.limits != (garnish.Limits{}) {
+		limits := r.limits
+		route.Limits = &limits
 	}
 
 	if r.slow > -1 {
@@ -197,6 +334,13 @@ func (r *Route) Build(runtime *garnish.Runtime) (*garnish.Route, error) {
 		route.Cache = garnish.NewRouteCache(r.cacheTTL, r.cacheKeyLookup)
 	}
 
+	if r.rewrite != nil {
+		route.Rewrite = r.rewrite.Build(r.path)
+		if r.rewrite.cacheKey && route.Cache != nil && route.Cache.KeyLookup == nil {
+			route.Cache.KeyLookup = garnish.RewrittenCacheKeyLookup
+		}
+	}
+
 	if len(r.upstream) > 0 {
 		upstream, exists := runtime.Upstreams[r.upstream]
 		if exists == false {
@@ -204,6 +348,30 @@ func (r *Route) Build(runtime *garnish.Runtime) (*garnish.Route, error) {
 		}
 		route.Upstream = upstream
 	}
+
+	if r.responseURLs.Redirects || r.responseURLs.Cookies {
+		urls := r.responseURLs
+		route.ResponseURLs = &urls
+	}
+
+	if r.split != nil {
+		if len(r.upstream) > 0 {
+			return nil, fmt.Errorf("Route %q has both an upstream and a split", r.name)
+		}
+		split, err := r.split.Build(runtime)
+		if err != nil {
+			return nil, fmt.Errorf("Route %q split: %v", r.name, err)
+		}
+		route.Split = split
+	}
+
+	if r.mirror != nil {
+		mirror, err := r.mirror.Build(runtime)
+		if err != nil {
+			return nil, fmt.Errorf("Route %q mirror: %v", r.name, err)
+		}
+		route.Mirror = mirror
+	}
 	runtime.Router.AddNamed(r.name, r.method, r.path, nil)
 	return route, nil
 }
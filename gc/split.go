@@ -0,0 +1,88 @@
+package gc
+
+import (
+	"fmt"
+	"gopkg.in/karlseguin/garnish.v1"
+)
+
+// Configuration for splitting a route's traffic between upstreams
+type Split struct {
+	targets   []splitTarget
+	sticky    garnish.SplitKey
+	overrides []splitOverride
+}
+
+type splitTarget struct {
+	upstream string
+	weight   int
+}
+
+type splitOverride struct {
+	header   string
+	value    string
+	upstream string
+}
+
+func NewSplit() *Split {
+	return &Split{}
+}
+
+// Send weight shares of the traffic to upstream. Targets should be added in
+// the same order on every reload, so that sticky requests stay put
+func (s *Split) Add(upstream string, weight uint32) *Split {
+	s.targets = append(s.targets, splitTarget{upstream, int(weight)})
+	return s
+}
+
+// Assign requests by the value of a cookie
+// [random]
+func (s *Split) StickyCookie(name string) *Split {
+	s.sticky = garnish.CookieSplitKey(name)
+	return s
+}
+
+// Assign requests by the value of a header
+// [random]
+func (s *Split) StickyHeader(name string) *Split {
+	s.sticky = garnish.HeaderSplitKey(name)
+	return s
+}
+
+// Assign requests by the value returned by key (say, the client's IP)
+// [random]
+func (s *Split) Sticky(key garnish.SplitKey) *Split {
+	s.sticky = key
+	return s
+}
+
+// Send requests with the header to upstream, regardless of weights. An
+// empty value matches any value: Force("X-Canary", "1", "users-canary")
+func (s *Split) Force(header, value, upstream string) *Split {
+	s.overrides = append(s.overrides, splitOverride{header, value, upstream})
+	return s
+}
+
+func (s *Split) Build(runtime *garnish.Runtime) (*garnish.Split, error) {
+	if len(s.targets) == 0 {
+		return nil, fmt.Errorf("split has no upstreams")
+	}
+	split := &garnish.Split{Sticky: s.sticky}
+	targets := make(map[string]*garnish.SplitTarget, len(s.targets))
+	for _, t := range s.targets {
+		upstream, exists := runtime.Upstreams[t.upstream]
+		if exists == false {
+			return nil, fmt.Errorf("unknown upstream %q", t.upstream)
+		}
+		target := &garnish.SplitTarget{Name: t.upstream, Upstream: upstream, Weight: t.weight}
+		split.Targets = append(split.Targets, target)
+		targets[t.upstream] = target
+	}
+	for _, o := range s.overrides {
+		target, exists := targets[o.upstream]
+		if exists == false {
+			return nil, fmt.Errorf("%s override references %q, which isn't part of the split", o.header, o.upstream)
+		}
+		split.Overrides = append(split.Overrides, garnish.SplitOverride{Header: o.header, Value: o.value, Target: target})
+	}
+	return split, nil
+}
@@ -44,6 +44,16 @@ func (s *Stats) Build(runtime *garnish.Runtime) error {
 	}
 	sw := garnish.NewStatsWorker(runtime, s.fileName)
 	runtime.StatsWorker = sw
+	for name, route := range runtime.Routes {
+		if route.Split == nil {
+			continue
+		}
+		for _, t := range route.Split.Targets {
+			stats := garnish.NewRouteStats(route.Stats.Treshold)
+			t.Stats = stats
+			runtime.RegisterStats("split-"+name+"-"+t.Name, func() map[string]int64 { return stats.Snapshot() })
+		}
+	}
 	go sw.Run()
 	return nil
 }
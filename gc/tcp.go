@@ -0,0 +1,97 @@
+package gc
+
+import (
+	"fmt"
+	"gopkg.in/karlseguin/garnish.v1"
+	"strings"
+	"time"
+)
+
+// Configuration for a raw TCP listener
+type TCP struct {
+	name           string
+	address        string
+	upstream       string
+	idleTimeout    time.Duration
+	maxConnections int64
+}
+
+func NewTCP(name string) *TCP {
+	return &TCP{
+		name:           name,
+		idleTimeout:    time.Minute * 5,
+		maxConnections: 1024,
+	}
+}
+
+// The address to listen on
+func (t *TCP) Address(address string) *TCP {
+	t.address = address
+	return t
+}
+
+// The upstream to proxy to. All of the upstream's addresses must
+// begin with tcp://
+func (t *TCP) Upstream(name string) *TCP {
+	t.upstream = name
+	return t
+}
+
+// Close connections which haven't seen any traffic for this long.
+// Set to 0 to never close idle connections
+// [5 minutes]
+func (t *TCP) IdleTimeout(timeout time.Duration) *TCP {
+	t.idleTimeout = timeout
+	return t
+}
+
+// The maximum number of concurrent connections. Set to 0 for no limit
+// [1024]
+func (t *TCP) MaxConnections(max uint32) *TCP {
+	t.maxConnections = int64(max)
+	return t
+}
+
+func (t *TCP) Build(runtime *garnish.Runtime) (*garnish.TCPProxy, error) {
+	if len(t.address) == 0 {
+		return nil, fmt.Errorf("tcp listener %s doesn't have an address", t.name)
+	}
+	upstream, ok := runtime.Upstreams[t.upstream]
+	if ok == false {
+		return nil, fmt.Errorf("tcp listener %s's upstream is %q, a non-existent upstream", t.name, t.upstream)
+	}
+	for _, transport := range upstream.Transports() {
+		if err := t.check(transport); err != nil {
+			return nil, err
+		}
+	}
+	// discovered transports have to pass the same check
+	for _, d := range runtime.Discoverers {
+		if d.Name != t.upstream {
+			continue
+		}
+		validate := d.Validate
+		d.Validate = func(transport *garnish.Transport) error {
+			if validate != nil {
+				if err := validate(transport); err != nil {
+					return err
+				}
+			}
+			return t.check(transport)
+		}
+	}
+	return &garnish.TCPProxy{
+		Name:           t.name,
+		Address:        t.address,
+		Upstream:       upstream,
+		IdleTimeout:    t.idleTimeout,
+		MaxConnections: t.maxConnections,
+	}, nil
+}
+
+func (t *TCP) check(transport *garnish.Transport) error {
+	if strings.HasPrefix(transport.Address, "tcp://") == false {
+		return fmt.Errorf("tcp listener %s's upstream %s has a non-tcp address: %q", t.name, t.upstream, transport.Address)
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package gc
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// TLS configuration for https transports
+type TLS struct {
+	ca         string
+	cert       string
+	key        string
+	serverName string
+	minVersion string
+	insecure   bool
+}
+
+func NewTLS() *TLS {
+	return &TLS{}
+}
+
+// Path to a PEM bundle of the certificate authorities to trust, instead of
+// the system's
+func (t *TLS) CA(path string) *TLS {
+	t.ca = path
+	return t
+}
+
+// Paths to the PEM certificate and key to present to the upstream
+// (mutual TLS)
+func (t *TLS) ClientCert(cert, key string) *TLS {
+	t.cert, t.key = cert, key
+	return t
+}
+
+// The name used for SNI and to verify the upstream's certificate
+// [the address' hostname]
+func (t *TLS) ServerName(name string) *TLS {
+	t.serverName = name
+	return t
+}
+
+// The minimum TLS version: "1.0", "1.1", "1.2" or "1.3"
+// ["1.2"]
+func (t *TLS) MinVersion(version string) *TLS {
+	t.minVersion = version
+	return t
+}
+
+// Don't verify the upstream's certificate. Meant for staging environments
+func (t *TLS) InsecureSkipVerify() *TLS {
+	t.insecure = true
+	return t
+}
+
+// host is used as the ServerName when one isn't configured. Since
+// connections are made to the ip the dns cache resolved, the certificate
+// must be verified against the original hostname
+func (t *TLS) Build(host string) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         host,
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: t != nil && t.insecure,
+	}
+	if t == nil {
+		return config, nil
+	}
+	if len(t.serverName) > 0 {
+		config.ServerName = t.serverName
+	}
+	if len(t.minVersion) > 0 {
+		version, ok := tlsVersions[t.minVersion]
+		if ok == false {
+			return nil, fmt.Errorf("unknown tls version %q", t.minVersion)
+		}
+		config.MinVersion = version
+	}
+	if len(t.ca) > 0 {
+		pem, err := os.ReadFile(t.ca)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if pool.AppendCertsFromPEM(pem) == false {
+			return nil, fmt.Errorf("no certificates found in %s", t.ca)
+		}
+		config.RootCAs = pool
+	}
+	if len(t.cert) > 0 || len(t.key) > 0 {
+		if len(t.cert) == 0 || len(t.key) == 0 {
+			return nil, errors.New("client certificate needs both a cert and a key")
+		}
+		cert, err := tls.LoadX509KeyPair(t.cert, t.key)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
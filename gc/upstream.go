@@ -1,10 +1,12 @@
 package gc
 
 import (
+	"context"
 	"fmt"
 	"gopkg.in/karlseguin/garnish.v1"
 	"net"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 )
@@ -28,10 +30,12 @@ func (u *Upstreams) Add(name string) *Upstream {
 		garnish.Log.Warnf("Upstream %q already defined. Overwriting.", name)
 	}
 	one := &Upstream{
-		name:        name,
-		dnsDuration: time.Minute,
-		headers:     DefaultHeaders,
-		transports:  make([]*Transport, 0, 2),
+		name:           name,
+		dnsDuration:    time.Minute,
+		connectTimeout: time.Second * 10,
+		idleTimeout:    time.Second * 90,
+		headers:        DefaultHeaders,
+		transports:     make([]*Transport, 0, 2),
 	}
 	u.upstreams[name] = one
 	return one
@@ -67,17 +71,33 @@ func (u *Upstreams) Build(runtime *garnish.Runtime, defaultTweaker garnish.Reque
 }
 
 type Upstream struct {
-	name        string
-	transports  []*Transport
-	dnsDuration time.Duration
-	headers     []string
-	tweakerRef  string
-	tweaker     garnish.RequestTweaker
+	name            string
+	transports      []*Transport
+	dnsDuration     time.Duration
+	connectTimeout  time.Duration
+	headerTimeout   time.Duration
+	idleTimeout     time.Duration
+	timeout         time.Duration
+	headers         []string
+	tweakerRef      string
+	tweaker         garnish.RequestTweaker
+	balancer        string
+	hashKey         garnish.HashKey
+	healthCheck     *HealthCheck
+	outliers        *Outliers
+	retry           *Retry
+	breaker         *Breaker
+	concurrency     *Concurrency
+	tls             *TLS
+	discovery       *Discovery
+	responseHeaders *ResponseHeaders
 }
 
 type Transport struct {
 	address   string
 	keepalive int
+	weight    int
+	tls       *TLS
 }
 
 // the duration to cache the upstream's dns lookup. Set to 0 to prevent
@@ -88,6 +108,40 @@ func (u *Upstream) DnsCache(duration time.Duration) *Upstream {
 	return u
 }
 
+// The time to wait for a connection to be established. Can be overwritten
+// on a per-route basis
+// [10 seconds]
+func (u *Upstream) ConnectTimeout(timeout time.Duration) *Upstream {
+	u.connectTimeout = timeout
+	return u
+}
+
+// The time to wait for the upstream's response headers once the
+// request has been written. Can be overwritten on a per-route basis.
+// 0 for no timeout
+// [0]
+func (u *Upstream) ResponseHeaderTimeout(timeout time.Duration) *Upstream {
+	u.headerTimeout = timeout
+	return u
+}
+
+// The time a keepalive connection can sit idle before it's closed
+// [90 seconds]
+func (u *Upstream) IdleConnTimeout(timeout time.Duration) *Upstream {
+	u.idleTimeout = timeout
+	return u
+}
+
+// The deadline for an entire request, from sending it to reading the
+// last byte of the response. Can be overwritten on a per-route basis.
+// Requests which time out get the configuration's GatewayTimeout response.
+// 0 for no timeout
+// [0]
+func (u *Upstream) Timeout(timeout time.Duration) *Upstream {
+	u.timeout = timeout
+	return u
+}
+
 // The headers to copy from the incoming request to the outgoing request
 // [Content-Length]
 func (u *Upstream) Headers(headers ...string) *Upstream {
@@ -109,12 +163,72 @@ func (u *Upstream) TweakerRef(upstream string) *Upstream {
 	return u
 }
 
-// the address to connect to. Should begin with unix:/  http://  or https://
+// The strategy used to pick which transport handles a request when the
+// upstream has more than one transport. One of "random", "roundrobin",
+// "weighted" (round robin which honors each transport's Weight),
+// "leastoutstanding" (the fewest in-flight requests), "p2c" (the least
+// busy of two randomly picked transports) or "hash" (requests with the
+// same key go to the same transport, see HashKey)
+// ["random"]
+func (u *Upstream) Balancer(name string) *Upstream {
+	u.balancer = name
+	return u
+}
+
+// Uses the "hash" balancer with a custom key. By default, the route's
+// primary cache key is used (or the URL's path when the route isn't cached)
+func (u *Upstream) HashKey(key garnish.HashKey) *Upstream {
+	u.balancer = "hash"
+	u.hashKey = key
+	return u
+}
+
+// Actively probe each of the upstream's transports by issuing a GET
+// for path. Transports which fail their health check are skipped
+// (unless all transports are failing).
+func (u *Upstream) HealthCheck(path string) *HealthCheck {
+	u.healthCheck = NewHealthCheck(path)
+	return u.healthCheck
+}
+
+// Passively eject transports which fail live requests (connection errors,
+// timeouts and 5xx responses). Ejected transports are skipped until their
+// ejection expires.
+func (u *Upstream) Outliers() *Outliers {
+	u.outliers = NewOutliers()
+	return u.outliers
+}
+
+// Retry failed requests up to attempts times in total (including the
+// initial request). Retries go to a different transport when possible.
+func (u *Upstream) Retry(attempts uint32) *Retry {
+	u.retry = NewRetry(attempts)
+	return u.retry
+}
+
+// Fail fast, with the configuration's CircuitOpen response, when the
+// upstream is failing
+func (u *Upstream) CircuitBreaker() *Breaker {
+	u.breaker = NewBreaker()
+	return u.breaker
+}
+
+// Limit the number of concurrent requests sent to the upstream. Additional
+// requests wait in a bounded queue and, if they can't get a slot in time,
+// get the configuration's Overloaded response
+func (u *Upstream) MaxConcurrent(max uint32) *Concurrency {
+	u.concurrency = NewConcurrency(max)
+	return u.concurrency
+}
+
+// the address to connect to. Should begin with unix:/  http://  https://
+// or tcp://
 // [""]
 func (u *Upstream) Address(address string) *Transport {
 	transport := &Transport{
 		address:   address,
 		keepalive: 16,
+		weight:    1,
 	}
 	u.transports = append(u.transports, transport)
 	return transport
@@ -127,62 +241,210 @@ func (t *Transport) KeepAlive(count uint32) *Transport {
 	return t
 }
 
+// the relative share of traffic this transport gets when the upstream
+// uses the weighted balancer
+// [1]
+func (t *Transport) Weight(weight uint32) *Transport {
+	t.weight = int(weight)
+	return t
+}
+
+// Get the upstream's addresses from a json or toml file, which is checked
+// for changes. Can't be combined with Address
+func (u *Upstream) DiscoverFile(path string) *Discovery {
+	u.discovery = NewDiscovery(NewFileSource(path), time.Second*5)
+	return u.discovery
+}
+
+// Get the upstream's addresses from a DNS SRV record (like
+// _http._tcp.users.internal). scheme is used to turn each target into an
+// address (http, https or tcp). Can't be combined with Address
+func (u *Upstream) DiscoverSRV(name string, scheme string) *Discovery {
+	u.discovery = NewDiscovery(NewSRVSource(name, scheme), time.Second*30)
+	return u.discovery
+}
+
+// TLS settings for the upstream's https transports. Can be overwritten
+// on a per-transport basis
+func (u *Upstream) TLS() *TLS {
+	u.tls = NewTLS()
+	return u.tls
+}
+
+// TLS settings for this transport (which must be https). Replaces the
+// upstream's TLS settings
+func (t *Transport) TLS() *TLS {
+	t.tls = NewTLS()
+	return t.tls
+}
+
+// Change the headers of responses sent to the client (applied before
+// the route's)
+func (u *Upstream) ResponseHeaders() *ResponseHeaders {
+	if u.responseHeaders == nil {
+		u.responseHeaders = NewResponseHeaders()
+	}
+	return u.responseHeaders
+}
+
 func (u *Upstream) Build(runtime *garnish.Runtime, tweaker garnish.RequestTweaker) (garnish.Upstream, error) {
-	l := len(u.transports)
+	configured := u.transports
+	var discover garnish.TransportBuilder
+	if d := u.discovery; d != nil {
+		if len(u.transports) > 0 {
+			return nil, fmt.Errorf("Upstream %s can't have both addresses and discovery", u.name)
+		}
+		endpoints, _, err := d.source.Endpoints()
+		if err != nil {
+			return nil, fmt.Errorf("Upstream %s discovery failed: %v", u.name, err)
+		}
+		configured = make([]*Transport, len(endpoints))
+		for i, e := range endpoints {
+			configured[i] = &Transport{address: e.Address, keepalive: d.keepalive, weight: e.Weight}
+		}
+		discover = func(e garnish.Endpoint) (*garnish.Transport, error) {
+			return u.buildTransport(runtime, &Transport{address: e.Address, keepalive: d.keepalive, weight: e.Weight})
+		}
+	}
+
+	l := len(configured)
 	if l == 0 {
 		return nil, fmt.Errorf("Upstream %s doesn't have a configured transport", u.name)
 	}
 
 	transports := make([]*garnish.Transport, l)
 	for i := 0; i < l; i++ {
-		t := u.transports[i]
-		if len(t.address) < 8 {
-			return nil, fmt.Errorf("Upstream %s has an invalid address: %q", u.name, t.address)
-		}
-		var domain string
-		if t.address[:7] == "http://" {
-			domain = t.address[7:]
-		} else if t.address[:8] == "https://" {
-			domain = t.address[8:]
-		}
-		if t.address[:6] != "unix:/" && len(domain) == 0 {
-			return nil, fmt.Errorf("Upstream %s's address should begin with unix:/, http:// or https://", u.name)
+		transport, err := u.buildTransport(runtime, configured[i])
+		if err != nil {
+			return nil, err
 		}
+		transports[i] = transport
+	}
+
+	if u.tweaker != nil {
+		tweaker = u.tweaker
+	}
+
+	balancer, err := garnish.NewBalancer(u.balancer)
+	if err != nil {
+		return nil, fmt.Errorf("Upstream %s has an %s", u.name, err)
+	}
+	if hb, ok := balancer.(*garnish.HashBalancer); ok && u.hashKey != nil {
+		hb.Key = u.hashKey
+	}
+	config := &garnish.UpstreamConfig{
+		Name:       u.name,
+		Headers:    u.headers,
+		Tweaker:    tweaker,
+		Balancer:   balancer,
+		Transports: transports,
+		Dynamic:    discover != nil,
 
-		transport := &http.Transport{
-			MaxIdleConnsPerHost: t.keepalive,
-			DisableKeepAlives:   t.keepalive == 0,
+		ResponseHeaders: u.responseHeaders.Build(),
+	}
+	if u.outliers != nil {
+		config.Outliers = u.outliers.Build()
+	}
+	if u.breaker != nil {
+		config.Breaker = u.breaker.Build(u.name)
+	}
+	if u.concurrency != nil {
+		if u.concurrency.max < 1 {
+			return nil, fmt.Errorf("Upstream %s's concurrency limit must be positive", u.name)
 		}
-		if t.address[:6] == "unix:/" {
-			transport.Dial = func(network, address string) (net.Conn, error) {
-				//strip out the :80 which Go adds
-				return net.Dial("unix", address[:len(address)-3])
-			}
-		} else if strings.Contains(t.address, "localhost") {
-			transport.Dial = func(network, address string) (net.Conn, error) {
-				return net.Dial(network, address)
-			}
-		} else {
-			transport.Dial = func(network, address string) (net.Conn, error) {
-				host, port, _ := net.SplitHostPort(address)
-				ip, _ := runtime.Resolver.FetchOneV4String(host)
-				return net.Dial(network, net.JoinHostPort(ip, port))
-			}
+		config.Limiter = u.concurrency.Build(u.name)
+	}
+	if u.retry != nil {
+		if config.Retry, err = u.retry.Build(); err != nil {
+			return nil, fmt.Errorf("Upstream %s has an %s", u.name, err)
+		}
+	}
+	upstream, err := garnish.CreateUpstream(config)
+	if err != nil {
+		return nil, err
+	}
+	if u.healthCheck != nil {
+		if u.healthCheck.interval <= 0 || u.healthCheck.timeout <= 0 {
+			return nil, fmt.Errorf("Upstream %s's health check needs a positive interval and timeout", u.name)
 		}
+		runtime.HealthCheckers = append(runtime.HealthCheckers, garnish.NewHealthChecker(u.name, upstream, u.healthCheck.Build()))
+	}
+	if discover != nil {
+		d := garnish.NewDiscoverer(u.name, upstream.(*garnish.MultiTransportUpstream), u.discovery.source, discover, u.discovery.interval, u.discovery.drain)
+		runtime.Discoverers = append(runtime.Discoverers, d)
+	}
+	return upstream, nil
+}
+
+func (u *Upstream) buildTransport(runtime *garnish.Runtime, t *Transport) (*garnish.Transport, error) {
+	if len(t.address) < 8 {
+		return nil, fmt.Errorf("Upstream %s has an invalid address: %q", u.name, t.address)
+	}
+	var domain string
+	if t.address[:7] == "http://" {
+		domain = t.address[7:]
+	} else if t.address[:8] == "https://" {
+		domain = t.address[8:]
+	} else if t.address[:6] == "tcp://" {
+		domain = t.address[6:]
+	}
+	if t.address[:6] != "unix:/" && len(domain) == 0 {
+		return nil, fmt.Errorf("Upstream %s's address should begin with unix:/, http://, https:// or tcp://", u.name)
+	}
 
-		if u.dnsDuration > 0 && len(domain) > 0 {
-			runtime.Resolver.TTL(domain, u.dnsDuration)
+	transport := &http.Transport{
+		MaxIdleConnsPerHost: t.keepalive,
+		DisableKeepAlives:   t.keepalive == 0,
+		IdleConnTimeout:     u.idleTimeout,
+	}
+	settings := t.tls
+	if settings == nil {
+		settings = u.tls
+	}
+	if t.address[:8] == "https://" {
+		target, err := url.Parse(t.address)
+		if err != nil {
+			return nil, fmt.Errorf("Upstream %s has an invalid address: %q", u.name, t.address)
+		}
+		if transport.TLSClientConfig, err = settings.Build(target.Hostname()); err != nil {
+			return nil, fmt.Errorf("Upstream %s has an invalid tls configuration: %v", u.name, err)
 		}
+	} else if t.tls != nil {
+		return nil, fmt.Errorf("Upstream %s's tls settings require an https:// address, got %q", u.name, t.address)
+	}
 
-		transports[i] = &garnish.Transport{
-			Transport: transport,
-			Address:   t.address,
+	// the connect timeout is applied per dial, so that routes can override it
+	dialer := new(net.Dialer)
+	var dial func(ctx context.Context, network, address string) (net.Conn, error)
+	if t.address[:6] == "unix:/" {
+		dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+			//strip out the :80 which Go adds
+			return dialer.DialContext(ctx, "unix", address[:len(address)-3])
 		}
+	} else if strings.Contains(t.address, "localhost") {
+		dial = dialer.DialContext
+	} else {
+		dial = (&resolvingDialer{dialer: dialer, resolver: runtime.Resolver}).DialContext
+	}
+	transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		ctx, cancel := garnish.ConnectContext(ctx, u.connectTimeout)
+		defer cancel()
+		return dial(ctx, network, address)
 	}
 
-	if u.tweaker != nil {
-		tweaker = u.tweaker
+	if u.dnsDuration > 0 && len(domain) > 0 {
+		runtime.Resolver.TTL(domain, u.dnsDuration)
 	}
 
-	return garnish.CreateUpstream(u.headers, tweaker, transports)
+	built := &garnish.Transport{
+		Transport:     transport,
+		Address:       t.address,
+		Weight:        t.weight,
+		Timeout:       u.timeout,
+		HeaderTimeout: u.headerTimeout,
+	}
+	if u.breaker != nil && u.breaker.perTransport {
+		built.Breaker = u.breaker.Build(u.name + " " + t.address)
+	}
+	return built, nil
 }
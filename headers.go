@@ -0,0 +1,99 @@
+package garnish
+
+import (
+	"net/http"
+	"strings"
+)
+
+type HeaderOp int
+
+const (
+	// Replace any existing values
+	SetHeader HeaderOp = iota
+	// Add a value, keeping the existing ones
+	AppendHeader
+	RemoveHeader
+	// Value is the new name
+	RenameHeader
+)
+
+// A change to a response's headers. Values (but not names) of Set and
+// Append can contain the {request.id}, {request.method}, {request.path},
+// {route.name} and {cache.status} (hit, grace, saint, revalidated or miss)
+// placeholders
+type HeaderRule struct {
+	Op    HeaderOp
+	Name  string
+	Value string
+}
+
+// Rules applied, in order, to the headers sent to the client
+type HeaderRules []HeaderRule
+
+// Applies the rules to header. Value slices are never modified in place,
+// since they might be shared with a cached response
+func (rules HeaderRules) Apply(req *Request, header http.Header) {
+	for _, rule := range rules {
+		name := http.CanonicalHeaderKey(rule.Name)
+		switch rule.Op {
+		case SetHeader:
+			header[name] = []string{expandHeader(rule.Value, req)}
+		case AppendHeader:
+			existing := header[name]
+			header[name] = append(existing[:len(existing):len(existing)], expandHeader(rule.Value, req))
+		case RemoveHeader:
+			delete(header, name)
+		case RenameHeader:
+			if values, ok := header[name]; ok {
+				delete(header, name)
+				header[http.CanonicalHeaderKey(rule.Value)] = values
+			}
+		}
+	}
+}
+
+func expandHeader(value string, req *Request) string {
+	if strings.IndexByte(value, '{') == -1 {
+		return value
+	}
+	var out strings.Builder
+	for {
+		start := strings.IndexByte(value, '{')
+		if start == -1 {
+			break
+		}
+		end := strings.IndexByte(value[start:], '}')
+		if end == -1 {
+			break
+		}
+		end += start
+		out.WriteString(value[:start])
+		if replacement, ok := headerPlaceholder(value[start+1:end], req); ok {
+			out.WriteString(replacement)
+		} else {
+			out.WriteString(value[start : end+1])
+		}
+		value = value[end+1:]
+	}
+	out.WriteString(value)
+	return out.String()
+}
+
+func headerPlaceholder(key string, req *Request) (string, bool) {
+	switch key {
+	case "request.id":
+		return req.Id, true
+	case "request.method":
+		return req.Method, true
+	case "request.path":
+		return req.URL.Path, true
+	case "route.name":
+		return req.Route.Name, true
+	case "cache.status":
+		if len(req.cache) > 0 {
+			return req.cache, true
+		}
+		return "miss", true
+	}
+	return "", false
+}
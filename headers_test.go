@@ -0,0 +1,46 @@
+package garnish
+
+import (
+	. "github.com/karlseguin/expect"
+	"github.com/karlseguin/expect/build"
+	"gopkg.in/karlseguin/params.v2"
+	"net/http"
+	"testing"
+)
+
+type HeadersTests struct{}
+
+func Test_Headers(t *testing.T) {
+	Expectify(new(HeadersTests), t)
+}
+
+func (_ HeadersTests) AppliesRulesInOrder() {
+	rules := HeaderRules{
+		{Op: RemoveHeader, Name: "server"},
+		{Op: RenameHeader, Name: "X-Debug", Value: "X-Upstream-Debug"},
+		{Op: SetHeader, Name: "X-Frame-Options", Value: "DENY"},
+		{Op: AppendHeader, Name: "Vary", Value: "Origin"},
+	}
+	h := http.Header{"Server": {"nginx"}, "X-Debug": {"1"}, "Vary": {"Accept"}}
+	rules.Apply(NewRequest(build.Request().Request, &Route{}, params.New(0)), h)
+	Expect(len(h)).To.Equal(3)
+	Expect(h["X-Upstream-Debug"]).To.Equal([]string{"1"})
+	Expect(h["X-Frame-Options"]).To.Equal([]string{"DENY"})
+	Expect(h["Vary"]).To.Equal([]string{"Accept", "Origin"})
+}
+
+func (_ HeadersTests) AppendDoesNotModifySharedValues() {
+	shared := make([]string, 1, 4)
+	shared[0] = "Accept"
+	h := http.Header{"Vary": shared}
+	HeaderRules{{Op: AppendHeader, Name: "Vary", Value: "Origin"}}.Apply(NewRequest(build.Request().Request, &Route{}, params.New(0)), h)
+	Expect(shared[:2]).To.Equal([]string{"Accept", ""})
+}
+
+func (_ HeadersTests) ExpandsPlaceholders() {
+	req := NewRequest(build.Request().Path("/users/1").Request, &Route{Name: "users"}, params.New(0))
+	req.Id = "req-1"
+	Expect(expandHeader("{route.name}/{request.id} {cache.status}", req)).To.Equal("users/req-1 miss")
+	req.Cached("grace")
+	Expect(expandHeader("{cache.status} {unknown} {", req)).To.Equal("grace {unknown} {")
+}
@@ -0,0 +1,145 @@
+package garnish
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Configuration for actively probing an upstream's transports
+type HealthCheck struct {
+	// The path to request (GET) from each transport. Ignored for tcp://
+	// transports, which are only expected to accept a connection
+	Path string
+
+	// How often to probe
+	Interval time.Duration
+
+	// How long to wait for a probe's response
+	Timeout time.Duration
+
+	// The status code a healthy transport is expected to reply with
+	Status int
+
+	// The number of consecutive successful probes needed to mark
+	// an unhealthy transport as healthy
+	Rise int
+
+	// The number of consecutive failed probes needed to mark
+	// a healthy transport as unhealthy
+	Fall int
+}
+
+// Background worker which probes an upstream's transports and flags them
+// as healthy or unhealthy. Unhealthy transports are skipped by the upstream
+// unless every transport is unhealthy (fail open).
+type HealthChecker struct {
+	Name     string
+	check    *HealthCheck
+	upstream Upstream
+	stop     chan struct{}
+}
+
+func NewHealthChecker(name string, upstream Upstream, check *HealthCheck) *HealthChecker {
+	return &HealthChecker{
+		Name:     name,
+		check:    check,
+		upstream: upstream,
+		stop:     make(chan struct{}),
+	}
+}
+
+// Run the worker
+func (h *HealthChecker) Run() {
+	h.probeAll()
+	for {
+		select {
+		case <-h.stop:
+			return
+		case <-time.After(h.check.Interval):
+			h.probeAll()
+		}
+	}
+}
+
+func (h *HealthChecker) Stop() {
+	close(h.stop)
+}
+
+// Reports the health of each transport (1 for healthy, 0 for unhealthy)
+func (h *HealthChecker) Stats() map[string]int64 {
+	transports := h.upstream.Transports()
+	stats := make(map[string]int64, len(transports)+2)
+	healthy := int64(0)
+	for _, t := range transports {
+		if t.Healthy() {
+			healthy++
+			stats[t.Address] = 1
+		} else {
+			stats[t.Address] = 0
+		}
+	}
+	stats["healthy"] = healthy
+	stats["unhealthy"] = int64(len(transports)) - healthy
+	return stats
+}
+
+func (h *HealthChecker) probeAll() {
+	var wg sync.WaitGroup
+	for _, t := range h.upstream.Transports() {
+		wg.Add(1)
+		go func(t *Transport) {
+			defer wg.Done()
+			h.record(t, h.probe(t))
+		}(t)
+	}
+	wg.Wait()
+}
+
+func (h *HealthChecker) probe(t *Transport) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), h.check.Timeout)
+	defer cancel()
+	if strings.HasPrefix(t.Address, "tcp://") {
+		conn, err := t.Dial(ctx)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}
+	req, err := http.NewRequest("GET", t.Address+h.check.Path, nil)
+	if err != nil {
+		Log.Errorf("upstream %s health check %s: %v", h.Name, t.Address, err)
+		return false
+	}
+	req.Header.Set("User-Agent", "garnish-health")
+	// go straight to the http.Transport so that probes don't count
+	// as outstanding requests
+	res, err := t.Transport.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		return false
+	}
+	res.Body.Close()
+	return res.StatusCode == h.check.Status
+}
+
+// Only ever called from the single goroutine probing t
+func (h *HealthChecker) record(t *Transport, ok bool) {
+	if ok == t.Healthy() {
+		t.streak = 0
+		return
+	}
+	t.streak++
+	if ok && t.streak >= h.check.Rise {
+		t.streak = 0
+		atomic.StoreInt32(&t.unhealthy, 0)
+		Log.Warnf("upstream %s transport %s is healthy", h.Name, t.Address)
+	} else if !ok && t.streak >= h.check.Fall {
+		t.streak = 0
+		atomic.StoreInt32(&t.unhealthy, 1)
+		Log.Warnf("upstream %s transport %s is unhealthy", h.Name, t.Address)
+	}
+}
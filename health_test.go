@@ -0,0 +1,60 @@
+package garnish
+
+import (
+	. "github.com/karlseguin/expect"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type HealthTests struct{}
+
+func Test_Health(t *testing.T) {
+	Log = NewFakeLogger()
+	Expectify(new(HealthTests), t)
+}
+
+func (_ HealthTests) FlagsTransportsAfterFallAndRise() {
+	status := 500
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	u, _ := CreateUpstream(&UpstreamConfig{Transports: []*Transport{&Transport{Transport: new(http.Transport), Address: server.URL}}})
+	h := NewHealthChecker("test", u, &HealthCheck{Path: "/ping", Timeout: time.Second, Status: 200, Rise: 1, Fall: 2})
+	t := u.Transport(nil)
+
+	h.probeAll()
+	Expect(t.Healthy()).To.Equal(true)
+	h.probeAll()
+	Expect(t.Healthy()).To.Equal(false)
+	Expect(h.Stats()["unhealthy"]).To.Equal(int64(1))
+
+	status = 200
+	h.probeAll()
+	Expect(t.Healthy()).To.Equal(true)
+	Expect(h.Stats()[server.URL]).To.Equal(int64(1))
+}
+
+func (_ HealthTests) SkipsUnhealthyTransports() {
+	u := &MultiTransportUpstream{transports: testTransports("a", "b", "c")}
+	u.transports[0].unhealthy = 1
+	u.transports[2].unhealthy = 1
+	for i := 0; i < 10; i++ {
+		Expect(u.Transport(nil).Address).To.Equal("b")
+	}
+}
+
+func (_ HealthTests) FailsOpenWhenAllTransportsAreUnhealthy() {
+	u := &MultiTransportUpstream{transports: testTransports("a", "b")}
+	u.transports[0].unhealthy = 1
+	u.transports[1].unhealthy = 1
+	hits := map[string]int{}
+	for i := 0; i < 100; i++ {
+		hits[u.Transport(nil).Address]++
+	}
+	Expect(hits["a"]).Greater.Than(0)
+	Expect(hits["b"]).Greater.Than(0)
+}
@@ -0,0 +1,179 @@
+package garnish
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Returned (by the upstream middleware) when a request couldn't get one of
+// the upstream's concurrency slots
+var ErrOverloaded = errors.New("upstream overloaded")
+
+// Limits the number of concurrent requests sent to an upstream. Requests
+// over the limit wait in a bounded FIFO queue for up to MaxWait.
+type ConcurrencyLimiter struct {
+	sync.Mutex
+	Name string
+
+	// The number of concurrent requests. Changes over time when Adaptive
+	// is set
+	Limit int
+
+	// The number of requests which can wait for a slot
+	Queue int
+
+	// How long a request can wait for a slot
+	MaxWait time.Duration
+
+	// Moves Limit based on observed latency, nil for a fixed limit
+	Adaptive *AdaptiveLimit
+
+	inFlight int
+	waiting  []chan struct{}
+	rejected int64
+	timedOut int64
+}
+
+// Adjusts a limit using AIMD: the limit grows by 1 when requests are
+// fast and the limit is being used, and is cut (multiplied by Backoff) when
+// a request fails or is slower than Tolerance times the lowest latency seen
+type AdaptiveLimit struct {
+	Min       int
+	Max       int
+	Tolerance float64
+	Backoff   float64
+
+	baseline  time.Duration
+	windowMin time.Duration
+	samples   int
+	decreased time.Time
+}
+
+// The number of samples after which the baseline latency is re-measured,
+// so that it can go up when the upstream gets slower for good
+const adaptiveWindow = 1000
+
+// Waits for a slot. When nil is returned, Release must be called once
+// the request is done. Returns ErrOverloaded when there's no room in the
+// queue or MaxWait passes, and ctx's error when ctx is done first
+func (l *ConcurrencyLimiter) Acquire(ctx context.Context) error {
+	l.Lock()
+	if l.inFlight < l.Limit {
+		l.inFlight++
+		l.Unlock()
+		return nil
+	}
+	if len(l.waiting) >= l.Queue || l.MaxWait <= 0 {
+		l.rejected++
+		l.Unlock()
+		return ErrOverloaded
+	}
+	granted := make(chan struct{})
+	l.waiting = append(l.waiting, granted)
+	l.Unlock()
+
+	timer := time.NewTimer(l.MaxWait)
+	defer timer.Stop()
+	err := ErrOverloaded
+	select {
+	case <-granted:
+		return nil
+	case <-timer.C:
+	case <-ctx.Done():
+		// the request's deadline (a timeout) or the client going away,
+		// neither of which is the upstream being overloaded
+		err = ctx.Err()
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	for i, w := range l.waiting {
+		if w == granted {
+			l.waiting = append(l.waiting[:i], l.waiting[i+1:]...)
+			if err == ErrOverloaded {
+				l.timedOut++
+			}
+			return err
+		}
+	}
+	// got a slot as we gave up, give it back
+	l.inFlight--
+	l.grant()
+	return err
+}
+
+// Gives back a slot. latency and ok are used by the adaptive limit. A
+// latency of 0 means the request was never sent
+func (l *ConcurrencyLimiter) Release(latency time.Duration, ok bool) {
+	l.Lock()
+	defer l.Unlock()
+	if l.Adaptive != nil {
+		l.Limit = l.Adaptive.adjust(l.Limit, l.inFlight, latency, ok, time.Now())
+	}
+	l.inFlight--
+	l.grant()
+}
+
+func (l *ConcurrencyLimiter) Stats() map[string]int64 {
+	l.Lock()
+	defer l.Unlock()
+	stats := map[string]int64{
+		"limit":    int64(l.Limit),
+		"inflight": int64(l.inFlight),
+		"queued":   int64(len(l.waiting)),
+		"rejected": l.rejected,
+		"timedout": l.timedOut,
+	}
+	l.rejected, l.timedOut = 0, 0
+	return stats
+}
+
+// must be called under lock
+func (l *ConcurrencyLimiter) grant() {
+	for l.inFlight < l.Limit && len(l.waiting) > 0 {
+		l.inFlight++
+		close(l.waiting[0])
+		l.waiting = l.waiting[1:]
+	}
+}
+
+// must be called under the limiter's lock
+func (a *AdaptiveLimit) adjust(limit, inFlight int, latency time.Duration, ok bool, now time.Time) int {
+	if latency <= 0 {
+		return limit
+	}
+	if ok {
+		if a.windowMin == 0 || latency < a.windowMin {
+			a.windowMin = latency
+		}
+		if a.samples++; a.samples >= adaptiveWindow || a.baseline == 0 {
+			a.baseline, a.windowMin, a.samples = a.windowMin, 0, 0
+		}
+	}
+
+	baseline := a.baseline
+	if a.windowMin > 0 && a.windowMin < baseline {
+		baseline = a.windowMin
+	}
+
+	if ok == false || float64(latency) > float64(baseline)*a.Tolerance {
+		// only back off once per round trip, a burst of slow responses
+		// is the same congestion event
+		if now.Sub(a.decreased) < baseline {
+			return limit
+		}
+		a.decreased = now
+		limit = int(float64(limit) * a.Backoff)
+		if limit < a.Min {
+			limit = a.Min
+		}
+		return limit
+	}
+
+	if inFlight >= limit && limit < a.Max {
+		limit++
+	}
+	return limit
+}
@@ -0,0 +1,77 @@
+package garnish
+
+import (
+	"context"
+	. "github.com/karlseguin/expect"
+	"testing"
+	"time"
+)
+
+type LimiterTests struct{}
+
+func Test_Limiter(t *testing.T) {
+	Expectify(new(LimiterTests), t)
+}
+
+func (_ LimiterTests) RejectsWhenTheQueueIsFull() {
+	l := &ConcurrencyLimiter{Limit: 1, Queue: 0, MaxWait: time.Second}
+	Expect(l.Acquire(context.Background())).To.Equal(nil)
+	Expect(l.Acquire(context.Background())).To.Equal(ErrOverloaded)
+	stats := l.Stats()
+	Expect(stats["rejected"]).To.Equal(int64(1))
+	Expect(stats["inflight"]).To.Equal(int64(1))
+}
+
+func (_ LimiterTests) QueuedRequestsGetReleasedSlots() {
+	l := &ConcurrencyLimiter{Limit: 1, Queue: 1, MaxWait: time.Second}
+	l.Acquire(context.Background())
+	acquired := make(chan error)
+	go func() { acquired <- l.Acquire(context.Background()) }()
+	for l.Stats()["queued"] == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	l.Release(time.Millisecond, true)
+	Expect(<-acquired).To.Equal(nil)
+	Expect(l.Stats()["inflight"]).To.Equal(int64(1))
+}
+
+func (_ LimiterTests) QueuedRequestsTimeOut() {
+	l := &ConcurrencyLimiter{Limit: 1, Queue: 1, MaxWait: time.Millisecond * 5}
+	l.Acquire(context.Background())
+	Expect(l.Acquire(context.Background())).To.Equal(ErrOverloaded)
+	stats := l.Stats()
+	Expect(stats["timedout"]).To.Equal(int64(1))
+	Expect(stats["queued"]).To.Equal(int64(0))
+}
+
+func (_ LimiterTests) AdaptiveGrowsWhenFast() {
+	l := &ConcurrencyLimiter{Limit: 2, Adaptive: &AdaptiveLimit{Min: 1, Max: 3, Tolerance: 2, Backoff: 0.5}}
+	for i := 0; i < 5; i++ {
+		l.Acquire(context.Background())
+		l.Acquire(context.Background())
+		l.Release(time.Millisecond, true)
+		l.Release(time.Millisecond, true)
+	}
+	Expect(l.Limit).To.Equal(3)
+}
+
+func (_ LimiterTests) AdaptiveBacksOffWhenSlow() {
+	a := &AdaptiveLimit{Min: 4, Max: 20, Tolerance: 2, Backoff: 0.5}
+	now := time.Now()
+	Expect(a.adjust(10, 1, time.Millisecond, true, now)).To.Equal(10)
+	Expect(a.adjust(10, 1, time.Millisecond*10, true, now)).To.Equal(5)
+	// not yet, the previous back off was too recent
+	Expect(a.adjust(5, 1, time.Millisecond*10, false, now.Add(time.Microsecond*500))).To.Equal(5)
+	Expect(a.adjust(5, 1, time.Millisecond*10, false, now.Add(time.Millisecond*2))).To.Equal(4)
+}
+
+func (_ LimiterTests) QueuedRequestsTimeOutWithTheirDeadline() {
+	l := &ConcurrencyLimiter{Limit: 1, Queue: 1, MaxWait: time.Second}
+	l.Acquire(context.Background())
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*5)
+	defer cancel()
+	Expect(l.Acquire(ctx)).To.Equal(context.DeadlineExceeded)
+	stats := l.Stats()
+	Expect(stats["queued"]).To.Equal(int64(0))
+	Expect(stats["timedout"]).To.Equal(int64(0))
+}
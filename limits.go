@@ -0,0 +1,132 @@
+package garnish
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"sync/atomic"
+)
+
+var (
+	ErrRequestTooLarge  = errors.New("request body too large")
+	ErrResponseTooLarge = errors.New("upstream response too large")
+)
+
+// Size limits, in bytes, on a route's requests and responses. 0 for no limit
+type Limits struct {
+	// Requests with a larger body are answered with a 413
+	MaxRequestBody int64
+
+	// Larger responses are streamed to the client but never cached
+	MaxCacheable int64
+
+	// Larger upstream responses are rejected (a 500) when the upstream says
+	// how big they are up front. When it doesn't, the 200 has already been
+	// sent by the time the limit is reached, so the body is cut off instead
+	MaxResponse int64
+
+	rejected  int64
+	uncached  int64
+	oversized int64
+	truncated int64
+}
+
+// Whether the response is small enough to be cached. When the length isn't
+// known, up to MaxCacheable bytes of a streaming response are read ahead
+func (l *Limits) Cacheable(res Response) bool {
+	if l == nil || l.MaxCacheable <= 0 {
+		return true
+	}
+	cl := int64(res.ContentLength())
+	if cl == -1 {
+		if s, ok := res.(*StreamingResponse); ok && s.readLimit(l.MaxCacheable) {
+			return true
+		}
+	} else if cl <= l.MaxCacheable {
+		return true
+	}
+	atomic.AddInt64(&l.uncached, 1)
+	return false
+}
+
+// Enforces MaxResponse on an upstream's response. Returns false if it's too
+// large to be sent at all
+func (l *Limits) Upstream(req *Request, res *http.Response) bool {
+	if l == nil || l.MaxResponse <= 0 {
+		return true
+	}
+	if res.ContentLength > l.MaxResponse {
+		atomic.AddInt64(&l.oversized, 1)
+		return false
+	}
+	if res.ContentLength == -1 {
+		res.Body = &limitedBody{ReadCloser: res.Body, remaining: l.MaxResponse, limits: l, req: req}
+	}
+	return true
+}
+
+// Limits the incoming request's body. Returns false if its Content-Length
+// is already too large
+func (l *Limits) Request(out http.ResponseWriter, req *http.Request) bool {
+	if l == nil || l.MaxRequestBody <= 0 || req.Body == nil || req.Body == http.NoBody {
+		return true
+	}
+	if req.ContentLength > l.MaxRequestBody {
+		return false
+	}
+	req.Body = http.MaxBytesReader(out, req.Body, l.MaxRequestBody)
+	return true
+}
+
+// Records a request rejected for having too large a body
+func (l *Limits) Reject() {
+	if l != nil {
+		atomic.AddInt64(&l.rejected, 1)
+	}
+}
+
+func (l *Limits) Stats() map[string]int64 {
+	return map[string]int64{
+		"rejected":  atomic.SwapInt64(&l.rejected, 0),
+		"uncached":  atomic.SwapInt64(&l.uncached, 0),
+		"oversized": atomic.SwapInt64(&l.oversized, 0),
+		"truncated": atomic.SwapInt64(&l.truncated, 0),
+	}
+}
+
+// An upstream body which errors once more than remaining bytes are read
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+	limits    *Limits
+	req       *Request
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, ErrResponseTooLarge
+	}
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		atomic.AddInt64(&b.limits.truncated, 1)
+		b.req.Errorf("upstream response cut off at %d bytes", b.limits.MaxResponse)
+		return n + int(b.remaining), ErrResponseTooLarge
+	}
+	return n, err
+}
+
+// Whether err is from reading a request body past its limit
+func IsRequestTooLarge(err error) bool {
+	var mbe *http.MaxBytesError
+	return errors.As(err, &mbe)
+}
+
+// A body with some bytes already read from it
+type readAhead struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,72 @@
+package garnish
+
+import (
+	"bytes"
+	. "github.com/karlseguin/expect"
+	"github.com/karlseguin/expect/build"
+	"gopkg.in/karlseguin/params.v2"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type LimitsTests struct{}
+
+func Test_Limits(t *testing.T) {
+	Expectify(new(LimitsTests), t)
+}
+
+func (_ LimitsTests) NilLimitsAllowEverything() {
+	var l *Limits
+	Expect(l.Cacheable(Respond(200, "hello"))).To.Equal(true)
+	Expect(l.Upstream(nil, &http.Response{ContentLength: 100})).To.Equal(true)
+	l.Reject()
+}
+
+func (_ LimitsTests) CachesResponsesUpToTheLimit() {
+	l := &Limits{MaxCacheable: 5}
+	Expect(l.Cacheable(Respond(200, "hello"))).To.Equal(true)
+	Expect(l.Cacheable(Respond(200, "hello!"))).To.Equal(false)
+
+	small := Streaming(200, make(http.Header), -1, io.NopCloser(strings.NewReader("hi")))
+	Expect(l.Cacheable(small)).To.Equal(true)
+	Expect(string(small.ToCacheable(zero).(*NormalResponse).body)).To.Equal("hi")
+	Expect(l.Stats()["uncached"]).To.Equal(int64(1))
+}
+
+func (_ LimitsTests) StreamsTheWholeOfAnUncacheableResponse() {
+	l := &Limits{MaxCacheable: 5}
+	res := Streaming(200, make(http.Header), -1, io.NopCloser(strings.NewReader("too big to cache")))
+	Expect(l.Cacheable(res)).To.Equal(false)
+	var out bytes.Buffer
+	res.Write(nil, &out)
+	Expect(out.String()).To.Equal("too big to cache")
+}
+
+func (_ LimitsTests) RejectsLargeUpstreamResponses() {
+	l := &Limits{MaxResponse: 5}
+	req := NewRequest(build.Request().Request, &Route{}, params.New(0))
+	Expect(l.Upstream(req, &http.Response{ContentLength: 6})).To.Equal(false)
+
+	res := &http.Response{ContentLength: -1, Body: io.NopCloser(strings.NewReader("hello world"))}
+	Expect(l.Upstream(req, res)).To.Equal(true)
+	body, err := io.ReadAll(res.Body)
+	Expect(string(body)).To.Equal("hello")
+	Expect(err).To.Equal(ErrResponseTooLarge)
+	stats := l.Stats()
+	Expect(stats["oversized"]).To.Equal(int64(1))
+	Expect(stats["truncated"]).To.Equal(int64(1))
+}
+
+func (_ LimitsTests) LimitsTheRequestBody() {
+	l := &Limits{MaxRequestBody: 5}
+	req := httptest.NewRequest("POST", "/", strings.NewReader("hello world"))
+	Expect(l.Request(httptest.NewRecorder(), req)).To.Equal(false)
+
+	req.ContentLength = -1
+	Expect(l.Request(httptest.NewRecorder(), req)).To.Equal(true)
+	_, err := io.ReadAll(req.Body)
+	Expect(IsRequestTooLarge(err)).To.Equal(true)
+}
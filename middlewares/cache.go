@@ -11,7 +11,7 @@ func Cache(req *garnish.Request, next garnish.Handler) garnish.Response {
 	config := req.Route.Cache
 
 	if req.Method == "PURGE" && cache.PurgeHandler != nil && config != nil {
-		if res := cache.PurgeHandler(req, config.KeyLookup, cache.Storage); res != nil {
+		if res := purge(req, cache, config); res != nil {
 			return res
 		}
 		return next(req)
@@ -22,31 +22,79 @@ func Cache(req *garnish.Request, next garnish.Handler) garnish.Response {
 	}
 	primary, secondary := config.KeyLookup(req)
 
-	item := cache.Storage.Get(primary, secondary)
+	item, stored := cache.Get(req, primary, secondary)
 	if item != nil {
 		now := time.Now()
 		expires := item.Expires()
 		if expires.After(now) {
-			req.Cached("hit")
-			return item
+			return serve(req, item, "hit")
 		}
+		// ask the upstream whether it has changed
+		req.Stale = item
 		if expires.Add(cache.GraceTTL).After(now) {
 			cache.Grace(primary, secondary, req, next)
-			req.Cached("grace")
-			return item
+			return serve(req, item, "grace")
 		}
 	}
 
 	req.Info("miss")
 	res := next(req)
-	if res == nil || res.Status() >= 500 {
+	if item != nil && res != nil && res.Status() == 304 {
+		res.Close()
+		item = cache.Revalidated(primary, stored, req.Route.Cache, item, res)
+		return serve(req, item, "revalidated")
+	}
+	if req.Runtime.IsFailure(res) {
 		if item == nil || cache.Saint == false {
 			return res
 		}
 		item.Expire(time.Now().Add(time.Second * 5))
-		req.Cached("saint")
-		return item
+		return serve(req, item, "saint")
+	}
+	if req.Method != "HEAD" {
+		// a HEAD response has no body to serve GETs with
+		cache.Set(req, primary, secondary, config, res)
+	}
+	return res
+}
+
+// Answers conditional requests with a 304, and HEAD requests (which share
+// the GET's entry) without the body
+func serve(req *garnish.Request, item garnish.CachedResponse, reason string) garnish.Response {
+	req.Cached(reason)
+	if res := garnish.NotModified(req, item); res != nil {
+		return res
+	}
+	if req.Method == "HEAD" {
+		return &garnish.HeadResponse{CachedResponse: item}
+	}
+	return item
+}
+
+// Runs the purge handler. A split route caches each target's response
+// separately, so the handler is run once per target. The first response
+// other than a miss is returned, or nil if any run returned nil
+func purge(req *garnish.Request, cache *garnish.Cache, config *garnish.RouteCache) garnish.Response {
+	split := req.Route.Split
+	if split == nil {
+		return cache.PurgeHandler(req, config.KeyLookup, cache.Storage)
+	}
+	target := req.Target
+	defer func() { req.Target = target }()
+
+	var res garnish.Response = garnish.PurgeMissResponse
+	proceed := false
+	for _, t := range split.Targets {
+		req.Target = t
+		r := cache.PurgeHandler(req, config.KeyLookup, cache.Storage)
+		if r == nil {
+			proceed = true
+		} else if res == garnish.PurgeMissResponse {
+			res = r
+		}
+	}
+	if proceed {
+		return nil
 	}
-	cache.Set(primary, secondary, config, res)
 	return res
 }
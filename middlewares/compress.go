@@ -0,0 +1,276 @@
+package middlewares
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"gopkg.in/karlseguin/garnish.v1"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Compresses responses for clients which accept gzip or deflate, and
+// decompresses gzip or deflate responses for clients which don't.
+// Sits outside the cache: cached responses are stored as the upstream sent
+// them and each encoding is kept alongside them as a variant, so a hit
+// isn't recompressed.
+type Compress struct {
+	// Responses with a known length smaller than this aren't compressed
+	MinSize int
+
+	// Compressible content types. An entry ending in / is a prefix (text/),
+	// one starting with + is a suffix (+json)
+	Types []string
+
+	// The gzip/zlib compression level
+	Level int
+
+	// Store the encoded variants of cached responses in the cache
+	CacheVariants bool
+}
+
+func (c *Compress) Handle(req *garnish.Request, next garnish.Handler) garnish.Response {
+	res := next(req)
+	if res == nil || c.eligible(res) == false {
+		return res
+	}
+
+	accepted := acceptedEncodings(req.Header.Get("Accept-Encoding"))
+	current := strings.ToLower(res.Header().Get("Content-Encoding"))
+	if len(current) != 0 {
+		if accepted[current] || (current != "gzip" && current != "deflate") {
+			return res
+		}
+		// the upstream compressed it, but the client can't take it
+		return c.transform(req, res, "identity")
+	}
+	if c.compressible(res) == false {
+		return res
+	}
+
+	encoding := ""
+	if accepted["gzip"] {
+		encoding = "gzip"
+	} else if accepted["deflate"] {
+		encoding = "deflate"
+	}
+	if len(encoding) == 0 {
+		return &encodedResponse{Response: res, header: varyHeader(res.Header())}
+	}
+	return c.transform(req, res, encoding)
+}
+
+func (c *Compress) eligible(res garnish.Response) bool {
+	status := res.Status()
+	if status < 200 || status == 204 || status == 206 || status == 304 {
+		return false
+	}
+	return strings.Contains(strings.ToLower(res.Header().Get("Cache-Control")), "no-transform") == false
+}
+
+func (c *Compress) compressible(res garnish.Response) bool {
+	if l := res.ContentLength(); l != -1 && l < c.MinSize {
+		return false
+	}
+	contentType := res.Header().Get("Content-Type")
+	if i := strings.IndexByte(contentType, ';'); i != -1 {
+		contentType = contentType[:i]
+	}
+	contentType = strings.ToLower(strings.TrimSpace(contentType))
+	if len(contentType) == 0 {
+		return false
+	}
+	for _, t := range c.Types {
+		if strings.HasSuffix(t, "/") {
+			if strings.HasPrefix(contentType, t) {
+				return true
+			}
+		} else if strings.HasPrefix(t, "+") {
+			if strings.HasSuffix(contentType, t) {
+				return true
+			}
+		} else if contentType == t {
+			return true
+		}
+	}
+	return false
+}
+
+// Encodes (or, for "identity", decodes) the response. A cached response
+// is converted once and the result stored as a variant which expires along
+// with it. Anything else is converted as it's written to the client.
+func (c *Compress) transform(req *garnish.Request, res garnish.Response, encoding string) garnish.Response {
+	header := varyHeader(res.Header())
+	if encoding == "identity" {
+		header.Del("Content-Encoding")
+	} else {
+		header.Set("Content-Encoding", encoding)
+	}
+	header.Del("Content-Length")
+	header.Del("Content-Md5")
+	if etag := header.Get("Etag"); len(etag) > 0 && strings.HasPrefix(etag, "W/") == false {
+		// the bytes differ, so a strong validator no longer holds
+		header.Set("Etag", "W/"+etag)
+	}
+
+	e := &encodedResponse{Response: res, header: header, encoding: encoding, level: c.Level}
+	cached, ok := res.(garnish.CachedResponse)
+	if ok == false || res.Cached() == false || c.CacheVariants == false || req.Route.Cache == nil || req.Method == "HEAD" {
+		return e
+	}
+
+	storage := req.Runtime.Cache.Storage
+	primary, secondary := req.Route.Cache.KeyLookup(req)
+	_, secondary = req.Runtime.Cache.Get(req, primary, secondary)
+	secondary += "\x00" + encoding
+	expires := cached.Expires()
+	if variant := storage.Get(primary, secondary); variant != nil && variant.Expires().Equal(expires) {
+		return variant
+	}
+
+	buffer := new(bytes.Buffer)
+	if err := e.encode(req.Runtime, buffer); err != nil {
+		// don't cache a broken variant
+		return req.FatalResponseErr("compress variant", err)
+	}
+	variant := garnish.RespondH(res.Status(), header, buffer.Bytes()).ToCacheable(expires)
+	storage.Set(primary, secondary, variant)
+	return variant
+}
+
+// A response whose headers and, when encoding is set, body differ from
+// the wrapped response's
+type encodedResponse struct {
+	garnish.Response
+	header   http.Header
+	encoding string
+	level    int
+}
+
+func (r *encodedResponse) ContentLength() int {
+	if len(r.encoding) == 0 {
+		return r.Response.ContentLength()
+	}
+	return -1
+}
+
+func (r *encodedResponse) Header() http.Header {
+	return r.header
+}
+
+func (r *encodedResponse) AddHeader(key, value string) garnish.Response {
+	r.header.Set(key, value)
+	return r
+}
+
+func (r *encodedResponse) Write(runtime *garnish.Runtime, w io.Writer) {
+	if err := r.encode(runtime, w); err != nil {
+		garnish.Log.Errorf("compress %s: %v", r.encoding, err)
+	}
+}
+
+// deflate is the zlib format (RFC 1950), not a raw deflate stream
+func (r *encodedResponse) encode(runtime *garnish.Runtime, w io.Writer) error {
+	switch r.encoding {
+	case "identity":
+		return r.decode(runtime, w)
+	case "gzip":
+		zw, err := gzip.NewWriterLevel(w, r.level)
+		if err != nil {
+			zw = gzip.NewWriter(w)
+		}
+		r.Response.Write(runtime, zw)
+		return zw.Close()
+	case "deflate":
+		zw, err := zlib.NewWriterLevel(w, r.level)
+		if err != nil {
+			zw = zlib.NewWriter(w)
+		}
+		r.Response.Write(runtime, zw)
+		return zw.Close()
+	}
+	r.Response.Write(runtime, w)
+	return nil
+}
+
+func (r *encodedResponse) decode(runtime *garnish.Runtime, w io.Writer) error {
+	pr, pw := io.Pipe()
+	go func() {
+		r.Response.Write(runtime, pw)
+		pw.Close()
+	}()
+	// unblocks the writer if we stop reading early
+	defer pr.Close()
+
+	var reader io.ReadCloser
+	var err error
+	if strings.EqualFold(r.Response.Header().Get("Content-Encoding"), "gzip") {
+		reader, err = gzip.NewReader(pr)
+	} else {
+		reader, err = zlib.NewReader(pr)
+	}
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	_, err = io.Copy(w, reader)
+	return err
+}
+
+// Copies the header, adding Accept-Encoding to Vary. The original might
+// belong to a cached response, so it's never changed
+func varyHeader(original http.Header) http.Header {
+	header := make(http.Header, len(original)+1)
+	for k, v := range original {
+		header[k] = v
+	}
+	for _, v := range header["Vary"] {
+		for _, field := range strings.Split(v, ",") {
+			field = strings.TrimSpace(field)
+			if field == "*" || strings.EqualFold(field, "Accept-Encoding") {
+				return header
+			}
+		}
+	}
+	vary := header["Vary"]
+	header["Vary"] = append(vary[:len(vary):len(vary)], "Accept-Encoding")
+	return header
+}
+
+// The encodings the client accepts (with a q greater than 0)
+func acceptedEncodings(value string) map[string]bool {
+	accepted := make(map[string]bool, 2)
+	wildcard := false
+	explicit := make(map[string]bool, 2)
+	for _, part := range strings.Split(value, ",") {
+		params := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(params[0]))
+		if len(name) == 0 {
+			continue
+		}
+		ok := true
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") || strings.HasPrefix(param, "Q=") {
+				q, err := strconv.ParseFloat(param[2:], 64)
+				ok = err == nil && q > 0
+			}
+		}
+		if name == "*" {
+			wildcard = ok
+			continue
+		}
+		explicit[name] = true
+		accepted[name] = ok
+	}
+	if wildcard {
+		for _, name := range []string{"gzip", "deflate"} {
+			if explicit[name] == false {
+				accepted[name] = true
+			}
+		}
+	}
+	return accepted
+}
@@ -0,0 +1,150 @@
+package middlewares
+
+import (
+	"bytes"
+	"context"
+	"gopkg.in/karlseguin/garnish.v1"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// Only bodies up to this size are compared when diffing a mirror
+const mirrorDiffLimit = 1024 * 1024
+
+// What the primary upstream returned, for comparing against the mirror
+type mirrored struct {
+	status int
+	body   []byte
+}
+
+// Starts sending a copy of the request to the route's mirror. When the
+// mirror diffs, the returned channel expects the primary's response
+// (see capture). The request is built up front since req (and its pooled
+// body) can't be used once the primary request completes.
+func mirror(req *garnish.Request, m *garnish.Mirror) chan<- mirrored {
+	if m.Acquire() == false {
+		return nil
+	}
+	transport := m.Upstream.Transport(req)
+	if transport == nil {
+		m.Done(true, false)
+		return nil
+	}
+
+	if req.Request.Body != nil && req.Request.Body != http.NoBody {
+		// buffer the body so that both upstreams can read it
+		req.Body()
+		if req.BodyTooLarge() {
+			m.Done(true, false)
+			return nil
+		}
+	}
+	// replaying copies the body, the mirror can outlive the request
+	out := createRequest(req, transport, m.Upstream, true)
+
+	var primary chan mirrored
+	if m.Diff {
+		primary = make(chan mirrored, 1)
+	}
+	id, url := req.Id, req.URL.String()
+	go func() {
+		ctx, cancel := context.Background(), context.CancelFunc(func() {})
+		if transport.Timeout > 0 {
+			ctx, cancel = context.WithTimeout(ctx, transport.Timeout)
+		}
+		defer cancel()
+
+		res, err := send(ctx, transport, out, transport.HeaderTimeout)
+		m.Upstream.Report(transport, err == nil && res.StatusCode < 500)
+		if err != nil {
+			garnish.Log.Infof("[%s] mirror %s %s: %v", id, m.Name, url, err)
+			m.Done(true, false)
+			return
+		}
+		var body []byte
+		if primary != nil {
+			body, _ = io.ReadAll(io.LimitReader(res.Body, mirrorDiffLimit+1))
+		}
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+		if primary == nil {
+			m.Done(false, false)
+			return
+		}
+
+		p, ok := <-primary
+		if ok == false {
+			// the primary failed, there's nothing to compare with
+			m.Done(false, false)
+			return
+		}
+		differs := false
+		if p.status != res.StatusCode {
+			differs = true
+			garnish.Log.Warnf("[%s] mirror %s %s status %d, primary %d", id, m.Name, url, res.StatusCode, p.status)
+		} else if p.body != nil && len(body) <= mirrorDiffLimit && bytes.Equal(p.body, body) == false {
+			differs = true
+			garnish.Log.Warnf("[%s] mirror %s %s body differs (%d bytes, primary %d)", id, m.Name, url, len(body), len(p.body))
+		}
+		m.Done(false, differs)
+	}()
+	return primary
+}
+
+// Sends the primary's response to a diffing mirror. Up to mirrorDiffLimit
+// of the body is copied as it streams to the client, and sent once the
+// body has been read or closed. Without a response (the primary failed),
+// the channel is closed.
+func capture(primary chan<- mirrored, res *http.Response) {
+	if res == nil {
+		close(primary)
+		return
+	}
+	res.Body = &mirrorTee{ReadCloser: res.Body, primary: primary, status: res.StatusCode, length: res.ContentLength, body: []byte{}}
+}
+
+type mirrorTee struct {
+	io.ReadCloser
+	once    sync.Once
+	status  int
+	length  int64
+	read    int64
+	body    []byte
+	primary chan<- mirrored
+}
+
+func (t *mirrorTee) Read(p []byte) (int, error) {
+	n, err := t.ReadCloser.Read(p)
+	if t.read += int64(n); t.body != nil && n > 0 {
+		if t.read > mirrorDiffLimit {
+			t.body = nil
+		} else {
+			t.body = append(t.body, p[:n]...)
+		}
+	}
+	// with a known length, readers can stop short of EOF
+	if err == io.EOF || (err == nil && t.read == t.length) {
+		t.send(true)
+	} else if err != nil {
+		t.send(false)
+	}
+	return n, err
+}
+
+func (t *mirrorTee) Close() error {
+	// closed before EOF, the body is incomplete
+	t.send(false)
+	return t.ReadCloser.Close()
+}
+
+func (t *mirrorTee) send(complete bool) {
+	t.once.Do(func() {
+		if complete && t.body != nil {
+			t.primary <- mirrored{status: t.status, body: t.body}
+		} else {
+			// only compare the status
+			t.primary <- mirrored{status: t.status}
+		}
+	})
+}
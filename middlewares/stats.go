@@ -11,7 +11,17 @@ func Stats(req *garnish.Request, next garnish.Handler) garnish.Response {
 		return nil
 	}
 	elapsed := time.Now().Sub(req.Start)
+	aborted := req.Aborted()
 	req.Route.Stats.Hit(res, elapsed)
+	if aborted {
+		req.Route.Stats.Abort()
+	}
+	if t := req.Target; t != nil && t.Stats != nil {
+		t.Stats.Hit(res, elapsed)
+		if aborted {
+			t.Stats.Abort()
+		}
+	}
 	req.Infof("%d µs", elapsed/1000)
 	return res
 }
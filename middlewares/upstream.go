@@ -1,44 +1,275 @@
 package middlewares
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"gopkg.in/karlseguin/garnish.v1"
+	"io"
 	"net"
 	"net/http"
 	"net/url"
-	"strings"
+	"sync"
+	"time"
 )
 
 func Upstream(req *garnish.Request, next garnish.Handler) garnish.Response {
+	if req.Upgrade() {
+		return upgrade(req)
+	}
+	var primary chan<- mirrored
+	if m := req.Route.Mirror; m != nil {
+		primary = mirror(req, m)
+	}
 	r, err := roundTrip(req)
+	if primary != nil {
+		capture(primary, r)
+	}
 	if err != nil {
+		if req.Aborted() {
+			req.Info("client aborted")
+			return garnish.AbortedResponse
+		}
+		if err == garnish.ErrRequestTooLarge || garnish.IsRequestTooLarge(err) {
+			return req.TooLargeResponse()
+		}
+		if err == garnish.ErrCircuitOpen {
+			req.Info("circuit open")
+			return req.Runtime.CircuitOpenResponse
+		}
+		if err == garnish.ErrOverloaded {
+			req.Info("upstream overloaded")
+			return req.Runtime.OverloadedResponse
+		}
+		if isTimeout(err) {
+			return req.TimeoutResponseErr("upstream roundtrip", err)
+		}
 		return req.FatalResponseErr("upstream roundtrip", err)
 	}
 	if r == nil {
 		return Catch(req)
 	}
 	req.Infof("%s | %d | %d", req.URL, r.StatusCode, r.ContentLength)
-	r.Header.Del("Connection")
+	if req.Route.Limits.Upstream(req, r) == false {
+		r.Body.Close()
+		return req.FatalResponse("upstream response too large")
+	}
+	garnish.RemoveHopHeaders(r.Header)
+	if m := req.Route.ResponseURLs; m != nil && r.Request != nil {
+		// the request's URL is that of the transport which answered
+		m.Apply(req, r.Request.URL, r.Header)
+	}
 	return garnish.Streaming(r.StatusCode, r.Header, r.ContentLength, r.Body)
 }
 
 func roundTrip(req *garnish.Request) (*http.Response, error) {
-	upstream := req.Route.Upstream
+	upstream := req.Upstream
 	if upstream == nil {
 		return nil, nil
 	}
 
-	transport := upstream.Transport()
+	transport := upstream.Transport(req)
 	if transport == nil {
 		//log?
 		return nil, nil
 	}
-	return transport.RoundTrip(createRequest(req, transport, upstream))
+
+	breaker := upstream.Breaker()
+	if breaker != nil && breaker.Allow() == false {
+		return nil, garnish.ErrCircuitOpen
+	}
+
+	// cancelled if the client goes away
+	ctx, cancel := req.Request.Context(), context.CancelFunc(nil)
+	timeout := req.Route.Timeout
+	if timeout == 0 {
+		timeout = transport.Timeout
+	}
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+	if connect := req.Route.ConnectTimeout; connect > 0 {
+		ctx = garnish.WithConnectTimeout(ctx, connect)
+	}
+
+	// waiting for a slot counts against the timeout
+	limiter := upstream.Limiter()
+	if limiter != nil {
+		if err := limiter.Acquire(ctx); err != nil {
+			if breaker != nil {
+				breaker.Release()
+			}
+			if cancel != nil {
+				cancel()
+			}
+			return nil, err
+		}
+	}
+	start := time.Now()
+	finish := func(latency time.Duration, ok bool) {
+		if limiter != nil {
+			limiter.Release(latency, ok)
+		}
+		if cancel != nil {
+			cancel()
+		}
+	}
+
+	attempts, replay := 1, false
+	policy := upstream.RetryPolicy()
+	if policy != nil && policy.Retryable(req.Method) {
+		policy.Deposit()
+		attempts = policy.Attempts
+		if req.ContentLength != 0 {
+			// buffer the body so that each attempt can send it
+			req.Body()
+			replay = true
+		}
+	}
+	if req.BodyTooLarge() {
+		// buffered (here or by the mirror) and cut short
+		if breaker != nil {
+			breaker.Release()
+		}
+		finish(0, true)
+		return nil, garnish.ErrRequestTooLarge
+	}
+
+	var tried []*garnish.Transport
+	for attempt := 1; ; attempt++ {
+		if transport.Breaker != nil && transport.Breaker.Allow() == false {
+			if breaker != nil {
+				if attempt == 1 {
+					breaker.Release()
+				} else {
+					// the previous attempt failed
+					breaker.Record(false)
+				}
+			}
+			finish(0, true)
+			return nil, garnish.ErrCircuitOpen
+		}
+		res, err := send(ctx, transport, createRequest(req, transport, upstream, replay), headerTimeout(req, transport))
+		if err != nil && (req.Aborted() || garnish.IsRequestTooLarge(err)) {
+			// the client hung up, or sent too large a body, which says
+			// nothing about the upstream
+			if transport.Breaker != nil {
+				transport.Breaker.Release()
+			}
+			if breaker != nil {
+				if attempt == 1 {
+					breaker.Release()
+				} else {
+					breaker.Record(false)
+				}
+			}
+			finish(0, true)
+			return nil, err
+		}
+		ok := err == nil && res.StatusCode < 500
+		upstream.Report(transport, ok)
+		if attempt < attempts && ctx.Err() == nil && policy.ShouldRetry(res, err) {
+			tried = append(tried, transport)
+			// nil once discovery has emptied the upstream, in which case
+			// this attempt's outcome is final
+			if next := upstream.Transport(req, tried...); next != nil && policy.Withdraw() {
+				if res != nil {
+					res.Body.Close()
+				}
+				transport = next
+				req.Infof("retrying on %s", transport.Address)
+				continue
+			}
+		}
+		// the upstream's breaker allowed the request once, so it only sees
+		// the final outcome (transports' breakers see every attempt)
+		if breaker != nil {
+			breaker.Record(ok)
+		}
+		latency := time.Since(start)
+		if err != nil {
+			finish(latency, false)
+		} else {
+			// the deadline, and the concurrency slot, cover reading the body,
+			// which happens after we return. latency only covers the headers
+			res.Body = &doneBody{ReadCloser: res.Body, done: func() { finish(latency, ok) }}
+		}
+		return res, err
+	}
+}
+
+var errHeaderTimeout = errors.New("timeout awaiting response headers")
+
+// Sends the request, giving up if the response headers haven't arrived
+// within timeout. Reading the body is only bound by the request's deadline
+func send(ctx context.Context, transport *garnish.Transport, out *http.Request, timeout time.Duration) (*http.Response, error) {
+	if timeout <= 0 {
+		return transport.RoundTrip(out.WithContext(ctx))
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	timer := time.AfterFunc(timeout, func() { cancel(errHeaderTimeout) })
+	res, err := transport.RoundTrip(out.WithContext(ctx))
+	if timer.Stop() == false {
+		// fired, possibly just as the headers arrived
+		if err == nil {
+			res.Body.Close()
+		}
+		cancel(nil)
+		return nil, errHeaderTimeout
+	}
+	if err != nil {
+		cancel(nil)
+		return nil, err
+	}
+	if res.StatusCode == http.StatusSwitchingProtocols {
+		// the caller owns the connection, the context no longer governs it
+		cancel(nil)
+		return res, nil
+	}
+	res.Body = &doneBody{ReadCloser: res.Body, done: func() { cancel(nil) }}
+	return res, nil
 }
 
-func createRequest(in *garnish.Request, transport *garnish.Transport, upstream garnish.Upstream) *http.Request {
-	targetUrl, err := url.Parse(transport.Address + in.URL.RequestURI())
+// The route's response header timeout, or the transport's
+func headerTimeout(req *garnish.Request, transport *garnish.Transport) time.Duration {
+	if timeout := req.Route.HeaderTimeout; timeout > 0 {
+		return timeout
+	}
+	return transport.HeaderTimeout
+}
+
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) || err == errHeaderTimeout {
+		return true
+	}
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// Releases the request's deadline (and concurrency slot) once the body
+// has been consumed
+type doneBody struct {
+	io.ReadCloser
+	once sync.Once
+	done func()
+}
+
+func (b *doneBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.done)
+	return err
+}
+
+// When replay is true, the body is left with the request so that it can be
+// sent again
+func createRequest(in *garnish.Request, transport *garnish.Transport, upstream garnish.Upstream, replay bool) *http.Request {
+	source := in.UpstreamURL
+	if source == nil {
+		source = in.URL
+	}
+	targetUrl, err := url.Parse(transport.Address + source.RequestURI())
 	if err != nil {
-		in.Errorf("upstream url %s %v", transport.Address+in.URL.RequestURI(), err)
+		in.Errorf("upstream url %s %v", transport.Address+source.RequestURI(), err)
 		targetUrl = in.URL
 	}
 	out := &http.Request{
@@ -53,7 +284,14 @@ func createRequest(in *garnish.Request, transport *garnish.Transport, upstream g
 		Header:        http.Header{"X-Request-Id": []string{in.Id}, "User-Agent": garnish.DefaultUserAgent},
 	}
 
-	if in.B != nil {
+	if in.B != nil && replay {
+		// a copy, the transport can still be writing it after the request
+		// returns its pooled buffer
+		b := make([]byte, in.B.Len())
+		copy(b, in.B.Bytes())
+		out.ContentLength = int64(len(b))
+		out.Body = io.NopCloser(bytes.NewReader(b))
+	} else if in.B != nil {
 		out.Body = in.B
 		in.B = nil //the upstream call will take care of closing it
 	} else {
@@ -67,12 +305,24 @@ func createRequest(in *garnish.Request, transport *garnish.Transport, upstream g
 		}
 	}
 
-	if clientIP, _, err := net.SplitHostPort(in.RemoteAddr); err == nil {
-		if prior, ok := out.Header["X-Forwarded-For"]; ok {
-			clientIP = strings.Join(prior, ", ") + ", " + clientIP
+	if stale := in.Stale; stale != nil {
+		if etag := stale.Header().Get("Etag"); len(etag) > 0 && garnish.GeneratedETag(stale) == false {
+			out.Header.Set("If-None-Match", etag)
 		}
-		out.Header.Set("X-Forwarded-For", clientIP)
+		if modified := stale.Header().Get("Last-Modified"); len(modified) > 0 {
+			out.Header.Set("If-Modified-Since", modified)
+		}
+	}
+
+	// out doesn't get the client's Connection header, but what it lists
+	// is still hop-by-hop
+	garnish.RemoveConnectionHeaders(out.Header, in.Header["Connection"])
+	garnish.RemoveHopHeaders(out.Header)
+	var forwarding *garnish.Forwarding
+	if in.Runtime != nil {
+		forwarding = in.Runtime.Forwarding
 	}
+	forwarding.Apply(in, out.Header)
 
 	if tweaker := upstream.Tweaker(); tweaker != nil {
 		tweaker(in, out)
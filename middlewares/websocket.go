@@ -0,0 +1,83 @@
+package middlewares
+
+import (
+	"gopkg.in/karlseguin/garnish.v1"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Sends an Upgrade request to the upstream. When the upstream switches
+// protocols, the runtime relays the connection, otherwise the upstream's
+// response is returned as-is. Upgraded connections are long lived, so they
+// aren't subject to the route's timeout, retries or concurrency limit.
+func upgrade(req *garnish.Request) garnish.Response {
+	upstream := req.Upstream
+	if upstream == nil {
+		return Catch(req)
+	}
+	transport := upstream.Transport(req)
+	if transport == nil {
+		return Catch(req)
+	}
+	breaker := upstream.Breaker()
+	if breaker != nil && breaker.Allow() == false {
+		req.Info("circuit open")
+		return req.Runtime.CircuitOpenResponse
+	}
+	if transport.Breaker != nil && transport.Breaker.Allow() == false {
+		if breaker != nil {
+			breaker.Release()
+		}
+		req.Info("circuit open")
+		return req.Runtime.CircuitOpenResponse
+	}
+
+	out := createRequest(req, transport, upstream, false)
+	for k, v := range req.Header {
+		if strings.HasPrefix(k, "Sec-Websocket-") || k == "Origin" {
+			out.Header[k] = v
+		}
+	}
+	out.Header.Set("Connection", "Upgrade")
+	out.Header.Set("Upgrade", req.Header.Get("Upgrade"))
+
+	ctx := out.Context()
+	if connect := req.Route.ConnectTimeout; connect > 0 {
+		ctx = garnish.WithConnectTimeout(ctx, connect)
+	}
+	res, err := send(ctx, transport, out, headerTimeout(req, transport))
+	if err != nil && req.Aborted() {
+		// the client hung up, which says nothing about the upstream
+		if transport.Breaker != nil {
+			transport.Breaker.Release()
+		}
+		if breaker != nil {
+			breaker.Release()
+		}
+		req.Info("client aborted")
+		return garnish.AbortedResponse
+	}
+	ok := err == nil && res.StatusCode < 500
+	upstream.Report(transport, ok)
+	if breaker != nil {
+		breaker.Record(ok)
+	}
+	if err != nil {
+		if isTimeout(err) {
+			return req.TimeoutResponseErr("upstream upgrade", err)
+		}
+		return req.FatalResponseErr("upstream upgrade", err)
+	}
+	req.Infof("%s | %d | upgrade", req.URL, res.StatusCode)
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		garnish.RemoveHopHeaders(res.Header)
+		return garnish.Streaming(res.StatusCode, res.Header, res.ContentLength, res.Body)
+	}
+	conn, ok := res.Body.(io.ReadWriteCloser)
+	if ok == false {
+		res.Body.Close()
+		return req.FatalResponse("upstream upgrade returned a read-only body")
+	}
+	return garnish.Upgraded(res.Header, conn, req.Route.WebSocketIdle)
+}
@@ -0,0 +1,67 @@
+package garnish
+
+import (
+	"math/rand"
+	"sync/atomic"
+)
+
+// Sends a copy of a route's requests to a second upstream. The mirror's
+// responses are discarded (or, with Diff, compared to the primary's and
+// any difference logged). The primary request never waits on the mirror.
+type Mirror struct {
+	Name     string
+	Upstream Upstream
+
+	// The percentage (0-100) of requests to mirror
+	Percent float64
+
+	// Log when the mirror's status or body differs from the primary's
+	Diff bool
+
+	// The maximum number of mirrored requests in flight, requests beyond
+	// this aren't mirrored. 0 for no limit
+	Max int64
+
+	inflight int64
+	sent     int64
+	dropped  int64
+	failed   int64
+	diffs    int64
+}
+
+// Whether the current request should be mirrored. When true, Done must be
+// called once the mirrored request completes
+func (m *Mirror) Acquire() bool {
+	if m.Percent < 100 && rand.Float64()*100 >= m.Percent {
+		return false
+	}
+	if atomic.AddInt64(&m.inflight, 1) > m.Max && m.Max > 0 {
+		atomic.AddInt64(&m.inflight, -1)
+		atomic.AddInt64(&m.dropped, 1)
+		return false
+	}
+	atomic.AddInt64(&m.sent, 1)
+	return true
+}
+
+// Records the end of a mirrored request. failed is true when the mirror
+// couldn't be reached, differs when its response didn't match the primary's
+func (m *Mirror) Done(failed bool, differs bool) {
+	atomic.AddInt64(&m.inflight, -1)
+	if failed {
+		atomic.AddInt64(&m.failed, 1)
+	}
+	if differs {
+		atomic.AddInt64(&m.diffs, 1)
+	}
+}
+
+func (m *Mirror) Stats() map[string]int64 {
+	return map[string]int64{
+		"inflight": atomic.LoadInt64(&m.inflight),
+		"sent":     atomic.SwapInt64(&m.sent, 0),
+		"dropped":  atomic.SwapInt64(&m.dropped, 0),
+		"failed":   atomic.SwapInt64(&m.failed, 0),
+		"diffs":    atomic.SwapInt64(&m.diffs, 0),
+	}
+}
@@ -0,0 +1,37 @@
+package garnish
+
+import (
+	. "github.com/karlseguin/expect"
+	"testing"
+)
+
+type MirrorTests struct{}
+
+func Test_Mirror(t *testing.T) {
+	Expectify(new(MirrorTests), t)
+}
+
+func (_ MirrorTests) AcquiresUpToMax() {
+	m := &Mirror{Percent: 100, Max: 2}
+	Expect(m.Acquire()).To.Equal(true)
+	Expect(m.Acquire()).To.Equal(true)
+	Expect(m.Acquire()).To.Equal(false)
+	m.Done(false, true)
+	Expect(m.Acquire()).To.Equal(true)
+	stats := m.Stats()
+	Expect(stats["sent"]).To.Equal(int64(3))
+	Expect(stats["dropped"]).To.Equal(int64(1))
+	Expect(stats["diffs"]).To.Equal(int64(1))
+	Expect(stats["inflight"]).To.Equal(int64(2))
+}
+
+func (_ MirrorTests) SamplesByPercent() {
+	m := &Mirror{Percent: 25}
+	acquired := 0
+	for i := 0; i < 10000; i++ {
+		if m.Acquire() {
+			acquired++
+		}
+	}
+	Expect(acquired > 2000 && acquired < 3000).To.Equal(true)
+}
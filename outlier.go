@@ -0,0 +1,103 @@
+package garnish
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Configuration for passively ejecting transports which are failing
+// live requests (connection errors, timeouts and 5xx responses)
+type OutlierDetection struct {
+	// Eject a transport after this many consecutive failures (0 disables)
+	Consecutive int
+
+	// Eject a transport when its failure rate within Window is
+	// above ErrorRate, a value between 0 and 1 (0 disables)
+	ErrorRate float64
+	Window    time.Duration
+
+	// The number of requests a transport must see within Window
+	// before its ErrorRate is considered
+	MinRequests int
+
+	// How long a transport is ejected for. Each repeat offence doubles
+	// the time, up to MaxEjection
+	Ejection    time.Duration
+	MaxEjection time.Duration
+
+	// The maximum percentage of an upstream's transports which can be
+	// ejected at any one time
+	MaxEjectedPercent int
+}
+
+// Per-transport state for outlier detection
+type outlier struct {
+	sync.Mutex
+	consecutive int
+	windowStart time.Time
+	requests    int
+	failures    int
+	ejections   uint
+	// unix nanoseconds, read without the lock
+	ejectedUntil int64
+}
+
+// Whether or not the transport is currently ejected
+func (t *Transport) Ejected(now time.Time) bool {
+	return atomic.LoadInt64(&t.outlier.ejectedUntil) > now.UnixNano()
+}
+
+// Records the outcome of a request to t. Returns true if the transport
+// should be ejected. The caller is responsible for enforcing the
+// MaxEjectedPercent cap and calling eject.
+func (d *OutlierDetection) record(t *Transport, ok bool, now time.Time) bool {
+	o := &t.outlier
+	o.Lock()
+	defer o.Unlock()
+
+	if now.Sub(o.windowStart) > d.Window {
+		o.windowStart, o.requests, o.failures = now, 0, 0
+	}
+	o.requests++
+
+	if ok {
+		o.consecutive = 0
+		// forgive past offences once the transport has behaved for a while
+		if o.ejections > 0 && now.UnixNano()-o.ejectedUntil > int64(d.MaxEjection) {
+			o.ejections = 0
+		}
+		return false
+	}
+
+	o.failures++
+	o.consecutive++
+	if t.Ejected(now) {
+		return false
+	}
+	if d.Consecutive > 0 && o.consecutive >= d.Consecutive {
+		return true
+	}
+	if d.ErrorRate > 0 && o.requests >= d.MinRequests && float64(o.failures)/float64(o.requests) > d.ErrorRate {
+		return true
+	}
+	return false
+}
+
+// Ejects the transport and returns how long it's ejected for
+func (d *OutlierDetection) eject(t *Transport, now time.Time) time.Duration {
+	o := &t.outlier
+	o.Lock()
+	defer o.Unlock()
+
+	duration := d.Ejection << o.ejections
+	if duration > d.MaxEjection || duration <= 0 {
+		duration = d.MaxEjection
+	} else {
+		o.ejections++
+	}
+	o.consecutive = 0
+	o.windowStart, o.requests, o.failures = now, 0, 0
+	atomic.StoreInt64(&o.ejectedUntil, now.Add(duration).UnixNano())
+	return duration
+}
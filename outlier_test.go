@@ -0,0 +1,100 @@
+package garnish
+
+import (
+	. "github.com/karlseguin/expect"
+	"sync"
+	"testing"
+	"time"
+)
+
+type OutlierTests struct{}
+
+func Test_Outlier(t *testing.T) {
+	Log = NewFakeLogger()
+	Expectify(new(OutlierTests), t)
+}
+
+func (_ OutlierTests) EjectsAfterConsecutiveFailures() {
+	u := outlierUpstream(&OutlierDetection{Consecutive: 3})
+	a := u.transports[0]
+	u.Report(a, false)
+	u.Report(a, false)
+	u.Report(a, true)
+	u.Report(a, false)
+	u.Report(a, false)
+	Expect(a.Ejected(time.Now())).To.Equal(false)
+	u.Report(a, false)
+	Expect(a.Ejected(time.Now())).To.Equal(true)
+	for i := 0; i < 10; i++ {
+		Expect(u.Transport(nil).Address).Not.To.Equal("a")
+	}
+}
+
+func (_ OutlierTests) EjectsOnErrorRate() {
+	u := outlierUpstream(&OutlierDetection{ErrorRate: 0.5, MinRequests: 4})
+	a := u.transports[0]
+	u.Report(a, false)
+	u.Report(a, true)
+	u.Report(a, false)
+	Expect(a.Ejected(time.Now())).To.Equal(false)
+	u.Report(a, false)
+	Expect(a.Ejected(time.Now())).To.Equal(true)
+}
+
+func (_ OutlierTests) BacksOffOnRepeatOffences() {
+	d := &OutlierDetection{Ejection: time.Second, MaxEjection: time.Second * 3}
+	a := &Transport{}
+	now := time.Now()
+	Expect(d.eject(a, now)).To.Equal(time.Second)
+	Expect(d.eject(a, now)).To.Equal(time.Second * 2)
+	Expect(d.eject(a, now)).To.Equal(time.Second * 3)
+	Expect(d.eject(a, now)).To.Equal(time.Second * 3)
+}
+
+func (_ OutlierTests) CapsTheShareOfEjectedTransports() {
+	u := outlierUpstream(&OutlierDetection{Consecutive: 1})
+	for _, t := range u.transports {
+		u.Report(t, false)
+	}
+	ejected := 0
+	for _, t := range u.transports {
+		if t.Ejected(time.Now()) {
+			ejected++
+		}
+	}
+	Expect(ejected).To.Equal(2)
+}
+
+func (_ OutlierTests) CapsEjectionsFromConcurrentFailures() {
+	u := outlierUpstream(&OutlierDetection{Consecutive: 1})
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		for _, t := range u.transports {
+			wg.Add(1)
+			go func(t *Transport) {
+				defer wg.Done()
+				u.Report(t, false)
+			}(t)
+		}
+	}
+	wg.Wait()
+	ejected := 0
+	for _, t := range u.transports {
+		if t.Ejected(time.Now()) {
+			ejected++
+		}
+	}
+	Expect(ejected).To.Equal(2)
+}
+
+func outlierUpstream(d *OutlierDetection) *MultiTransportUpstream {
+	d.Window = time.Minute
+	if d.Ejection == 0 {
+		d.Ejection, d.MaxEjection = time.Minute, time.Minute
+	}
+	d.MaxEjectedPercent = 50
+	return &MultiTransportUpstream{
+		outliers:   d,
+		transports: testTransports("a", "b", "c", "d"),
+	}
+}
@@ -0,0 +1,110 @@
+package garnish
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Maps the upstream's URLs in response headers (Location, Content-Location,
+// Refresh and Set-Cookie's Domain and Path) back to the ones the client
+// used, like nginx's proxy_redirect and proxy_cookie_* directives
+type ResponseURLs struct {
+	// Rewrite Location, Content-Location and Refresh
+	Redirects bool
+
+	// Rewrite the Domain and Path of cookies
+	Cookies bool
+}
+
+// upstream is the URL the request was sent to
+func (m *ResponseURLs) Apply(req *Request, upstream *url.URL, header http.Header) {
+	if m.Redirects {
+		for _, name := range []string{"Location", "Content-Location"} {
+			if value := header.Get(name); len(value) > 0 {
+				header.Set(name, reverseURL(req, upstream, value))
+			}
+		}
+		if value := header.Get("Refresh"); len(value) > 0 {
+			if i := strings.Index(strings.ToLower(value), "url="); i != -1 {
+				header.Set("Refresh", value[:i+4]+reverseURL(req, upstream, value[i+4:]))
+			}
+		}
+	}
+	if m.Cookies {
+		cookies := header["Set-Cookie"]
+		for i, cookie := range cookies {
+			cookies[i] = reverseCookie(req, upstream, cookie)
+		}
+	}
+}
+
+// Wraps a CacheKeyLookup so that responses are cached separately for each
+// host and scheme clients use, since Apply maps the upstream's URLs to them
+func ResponseURLsCacheKeyLookup(lookup CacheKeyLookup) CacheKeyLookup {
+	return func(req *Request) (string, string) {
+		primary, secondary := lookup(req)
+		return primary, secondary + "#" + publicScheme(req) + "://" + req.Host
+	}
+}
+
+// Absolute URLs pointing to the upstream are changed to point to the
+// host the client used. Paths are mapped back through the route's Rewrite
+func reverseURL(req *Request, upstream *url.URL, raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return raw
+	}
+	if len(u.Host) > 0 {
+		// absolute or protocol-relative (//host/path)
+		if u.Host != upstream.Host {
+			// not ours (or already public)
+			return raw
+		}
+		if len(u.Scheme) > 0 {
+			u.Scheme = publicScheme(req)
+		}
+		u.Host = req.Host
+	} else if u.IsAbs() || strings.HasPrefix(u.Path, "/") == false {
+		// not a URL we can map (mailto:), or relative to the current
+		// path, which the client already sees
+		return raw
+	}
+	u.Path = req.Route.Rewrite.Reverse(u.Path)
+	u.RawPath = ""
+	return u.String()
+}
+
+func reverseCookie(req *Request, upstream *url.URL, cookie string) string {
+	parts := strings.Split(cookie, ";")
+	for i := 1; i < len(parts); i++ {
+		attribute := strings.TrimSpace(parts[i])
+		lower := strings.ToLower(attribute)
+		if strings.HasPrefix(lower, "domain=") {
+			domain := strings.TrimPrefix(attribute[7:], ".")
+			if strings.EqualFold(domain, upstream.Hostname()) {
+				host := req.Host
+				if h, _, err := net.SplitHostPort(host); err == nil {
+					host = h
+				}
+				parts[i] = " Domain=" + host
+			}
+		} else if strings.HasPrefix(lower, "path=") {
+			parts[i] = " Path=" + req.Route.Rewrite.Reverse(attribute[5:])
+		}
+	}
+	return strings.Join(parts, ";")
+}
+
+func publicScheme(req *Request) string {
+	if req.Runtime != nil && req.Runtime.Forwarding.Trusts(req.RemoteAddr) {
+		if proto := req.Header.Get("X-Forwarded-Proto"); len(proto) > 0 {
+			return proto
+		}
+	}
+	if req.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
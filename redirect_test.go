@@ -0,0 +1,69 @@
+package garnish
+
+import (
+	. "github.com/karlseguin/expect"
+	"github.com/karlseguin/expect/build"
+	"gopkg.in/karlseguin/params.v2"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+type RedirectTests struct{}
+
+func Test_Redirect(t *testing.T) {
+	Expectify(new(RedirectTests), t)
+}
+
+func (_ RedirectTests) RewritesRedirectsToTheUpstream() {
+	header := http.Header{
+		"Location":         {"http://10.0.0.5:4005/v2/users/3?a=1"},
+		"Content-Location": {"/v2/users/3"},
+		"Refresh":          {"5; url=http://10.0.0.5:4005/v2/login"},
+	}
+	(&ResponseURLs{Redirects: true}).Apply(NewRequest(build.Request().Host("garnish.io").Path("/api/users/3").Request, &Route{Rewrite: &Rewrite{StripPrefix: "/api", AddPrefix: "/v2"}}, params.New(0)), &url.URL{Scheme: "http", Host: "10.0.0.5:4005", Path: "/v2/users/3"}, header)
+	Expect(header.Get("Location")).To.Equal("http://garnish.io/api/users/3?a=1")
+	Expect(header.Get("Content-Location")).To.Equal("/api/users/3")
+	Expect(header.Get("Refresh")).To.Equal("5; url=http://garnish.io/api/login")
+}
+
+func (_ RedirectTests) RewritesProtocolRelativeRedirects() {
+	header := http.Header{"Location": {"//10.0.0.5:4005/v2/users/3"}}
+	(&ResponseURLs{Redirects: true}).Apply(NewRequest(build.Request().Host("garnish.io").Path("/api/users/3").Request, &Route{Rewrite: &Rewrite{StripPrefix: "/api", AddPrefix: "/v2"}}, params.New(0)), &url.URL{Scheme: "http", Host: "10.0.0.5:4005", Path: "/v2/users/3"}, header)
+	Expect(header.Get("Location")).To.Equal("//garnish.io/api/users/3")
+}
+
+func (_ RedirectTests) LeavesOtherRedirectsAlone() {
+	header := http.Header{"Location": {"https://accounts.example.com/v2/login"}}
+	(&ResponseURLs{Redirects: true}).Apply(NewRequest(build.Request().Host("garnish.io").Path("/api/users/3").Request, &Route{Rewrite: &Rewrite{StripPrefix: "/api", AddPrefix: "/v2"}}, params.New(0)), &url.URL{Scheme: "http", Host: "10.0.0.5:4005", Path: "/v2/users/3"}, header)
+	Expect(header.Get("Location")).To.Equal("https://accounts.example.com/v2/login")
+}
+
+func (_ RedirectTests) RewritesCookies() {
+	header := http.Header{"Set-Cookie": {
+		"session=1; Domain=.10.0.0.5; Path=/v2/users; HttpOnly",
+		"theme=dark; Domain=example.com; Path=/",
+	}}
+	(&ResponseURLs{Cookies: true}).Apply(NewRequest(build.Request().Host("garnish.io").Path("/api/users/3").Request, &Route{Rewrite: &Rewrite{StripPrefix: "/api", AddPrefix: "/v2"}}, params.New(0)), &url.URL{Scheme: "http", Host: "10.0.0.5:4005", Path: "/v2/users/3"}, header)
+	Expect(header["Set-Cookie"][0]).To.Equal("session=1; Domain=garnish.io; Path=/api/users; HttpOnly")
+	Expect(header["Set-Cookie"][1]).To.Equal("theme=dark; Domain=example.com; Path=/")
+}
+
+func (_ RedirectTests) CachesEachHostSeparately() {
+	lookup := ResponseURLsCacheKeyLookup(DefaultCacheKeyLookup)
+	req := NewRequest(build.Request().Host("garnish.io").Path("/api/users/3").Request, &Route{Rewrite: &Rewrite{StripPrefix: "/api", AddPrefix: "/v2"}}, params.New(0))
+	primary, secondary := lookup(req)
+	Expect(primary).To.Equal("/api/users/3")
+	Expect(secondary).To.Equal("#http://garnish.io")
+	req.Host = "www.garnish.io"
+	_, secondary = lookup(req)
+	Expect(secondary).To.Equal("#http://www.garnish.io")
+}
+
+func (_ RedirectTests) ReversesRewrittenPaths() {
+	rw := &Rewrite{StripPrefix: "/api", AddPrefix: "/v2"}
+	Expect(rw.Reverse("/v2/users")).To.Equal("/api/users")
+	Expect(rw.Reverse("/v2")).To.Equal("/api/")
+	Expect(rw.Reverse("/v20/users")).To.Equal("/v20/users")
+	Expect((*Rewrite)(nil).Reverse("/users")).To.Equal("/users")
+}
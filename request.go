@@ -6,6 +6,7 @@ import (
 	"gopkg.in/karlseguin/params.v2"
 	"net/http"
 	"net/url"
+	"strings"
 	"time"
 )
 
@@ -15,9 +16,11 @@ var (
 
 // Extends an *http.Request
 type Request struct {
-	hit    bool
-	scope  string
-	params *params.Params
+	hit      bool
+	tooLarge bool
+	cache    string
+	scope    string
+	params   *params.Params
 
 	// wraps request.Url.Query without having to re-parse it on each request
 	Query url.Values
@@ -37,6 +40,21 @@ type Request struct {
 	// The route this request is associated with
 	Route *Route
 
+	// The URL (path and query) sent to the upstream. The same as URL unless
+	// the route has rewrite rules
+	UpstreamURL *url.URL
+
+	// The upstream the request is sent to. The route's, or the one picked
+	// by the route's split
+	Upstream Upstream
+
+	// The split target serving the request, nil unless the route is split
+	Target *SplitTarget
+
+	// An expired cache entry being refetched. Its ETag and Last-Modified are
+	// sent to the upstream which can answer with a 304 if it hasn't changed
+	Stale CachedResponse
+
 	// Garnish's runtime
 	Runtime *Runtime
 
@@ -45,15 +63,27 @@ type Request struct {
 }
 
 func NewRequest(req *http.Request, route *Route, params *params.Params) *Request {
-	return &Request{
-		scope:   "root",
-		Request: req,
-		Route:   route,
-		params:  params,
-		Start:   nd.Now(),
-		Query:   req.URL.Query(),
-		Id:      nd.Guidv4String(),
+	r := &Request{
+		scope:       "root",
+		Request:     req,
+		Route:       route,
+		params:      params,
+		Start:       nd.Now(),
+		Query:       req.URL.Query(),
+		Id:          nd.Guidv4String(),
+		UpstreamURL: req.URL,
 	}
+	if route != nil {
+		if route.Rewrite != nil {
+			r.UpstreamURL = route.Rewrite.Apply(r)
+		}
+		r.Upstream = route.Upstream
+		if route.Split != nil {
+			r.Target = route.Split.Pick(r)
+			r.Upstream = r.Target.Upstream
+		}
+	}
+	return r
 }
 
 // Params are values extracted from the URL of a route.
@@ -65,8 +95,28 @@ func (r *Request) Params(key string) string {
 
 // Whether the request could be cached or not
 func (r *Request) Cacheable() bool {
-	return (r.Method == "GET" || r.Method == "HEAD" || r.Method == "OPTIONS") && r.Route.Cache.TTL > 0
+	return (r.Method == "GET" || r.Method == "HEAD" || r.Method == "OPTIONS") && r.Route.Cache.TTL > 0 && r.Upgrade() == false
+}
 
+// Whether the client has gone away (or, for a grace refresh, never)
+func (r *Request) Aborted() bool {
+	return r.Request.Context().Err() != nil
+}
+
+// Whether this is an Upgrade (websocket) request on a route which
+// proxies them
+func (r *Request) Upgrade() bool {
+	if r.Route == nil || r.Route.WebSocket == false || len(r.Header.Get("Upgrade")) == 0 {
+		return false
+	}
+	for _, value := range r.Header["Connection"] {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 // Gets a querystring value. If the key holds an array of values, returns
@@ -87,23 +137,35 @@ func (r *Request) Body() []byte {
 			return nil
 		}
 		r.B = r.Runtime.BytePool.Checkout()
-		r.B.ReadFrom(r.Request.Body)
+		if _, err := r.B.ReadFrom(r.Request.Body); IsRequestTooLarge(err) {
+			r.tooLarge = true
+		}
 		r.Request.Body.Close()
 	}
 	return r.B.Bytes()
 }
 
+// Whether the body, read by Body(), went past the route's MaxRequestBody
+// (in which case Body() only has part of it)
+func (r *Request) BodyTooLarge() bool {
+	return r.tooLarge
+}
+
 // For now we don't clone the body.
 // Clone is only used by the cache/grace right now, what are the chances
 // that we want to cache a GET request with a body?
 func (r *Request) Clone() *Request {
 	clone := &Request{
-		Id:      r.Id,
-		Route:   r.Route,
-		scope:   r.scope,
-		Start:   r.Start,
-		Request: r.Request,
-		Runtime: r.Runtime,
+		Id:          r.Id,
+		Route:       r.Route,
+		scope:       r.scope,
+		Start:       r.Start,
+		Request:     r.Request,
+		Runtime:     r.Runtime,
+		UpstreamURL: r.UpstreamURL,
+		Upstream:    r.Upstream,
+		Target:      r.Target,
+		Stale:       r.Stale,
 	}
 	if r.params.Len() == 0 {
 		clone.params = EmptyParams
@@ -127,6 +189,7 @@ func (r *Request) Close() {
 
 func (r *Request) Cached(reason string) {
 	r.hit = true
+	r.cache = reason
 	r.Info(reason)
 }
 
@@ -164,6 +227,17 @@ func (r *Request) FatalResponseErr(message string, err error) Response {
 	return r.Runtime.FatalResponse
 }
 
+func (r *Request) TooLargeResponse() Response {
+	r.Info("request body too large")
+	r.Route.Limits.Reject()
+	return r.Runtime.PayloadTooLargeResponse
+}
+
+func (r *Request) TimeoutResponseErr(message string, err error) Response {
+	r.Errorf("%s: %s", message, err)
+	return r.Runtime.TimeoutResponse
+}
+
 // a request builder
 type ReqBuilder struct {
 	Request *Request
@@ -37,6 +37,8 @@ type Response interface {
 	// When detached is true, it's expected that the original
 	// response will continue to be used. Detached = false is
 	// an optimization for grace mode which discards the original response
+	// Returns nil when the body couldn't be read (say, the client went
+	// away and the upstream request was cancelled)
 	ToCacheable(ttl time.Time) CachedResponse
 
 	// Releases any resources associated with the response
@@ -103,6 +105,9 @@ type NormalResponse struct {
 	status  int
 	header  http.Header
 	expires time.Time
+
+	// the ETag was generated by garnish, the upstream doesn't know it
+	generatedETag bool
 }
 
 func (r *NormalResponse) ContentLength() int {
@@ -150,8 +155,18 @@ func (r *NormalResponse) Expire(at time.Time) {
 }
 
 func (r *NormalResponse) Serialize(serializer Serializer) error {
+	header := r.header
+	if r.generatedETag {
+		// the flag isn't persisted, so neither is the ETag (it'd be sent
+		// to the upstream once loaded)
+		header = make(http.Header, len(r.header))
+		for k, v := range r.header {
+			header[k] = v
+		}
+		delete(header, "Etag")
+	}
 	serializer.WriteInt(r.status)
-	serializeHeader(serializer, r.header)
+	serializeHeader(serializer, header)
 	serializer.Write(r.body)
 	return nil
 }
@@ -172,6 +187,7 @@ type StreamingResponse struct {
 	status        int
 	header        http.Header
 	contentLength int64
+	err           error
 }
 
 func Streaming(status int, header http.Header, contentLength int64, body io.ReadCloser) Response {
@@ -215,6 +231,9 @@ func (r *StreamingResponse) ToCacheable(expires time.Time) CachedResponse {
 	if r.bytes == nil {
 		r.read()
 	}
+	if r.err != nil {
+		return nil
+	}
 	return &NormalResponse{
 		body:    r.bytes,
 		header:  r.header,
@@ -226,18 +245,36 @@ func (r *StreamingResponse) ToCacheable(expires time.Time) CachedResponse {
 func (r *StreamingResponse) read() {
 	if r.contentLength > 0 {
 		r.bytes = make([]byte, r.contentLength)
-		io.ReadFull(r.body, r.bytes)
+		_, r.err = io.ReadFull(r.body, r.bytes)
 		return
 	}
 
 	tmp := bytes.NewBuffer(make([]byte, 0, 65536))
-	io.Copy(tmp, r.body)
+	_, r.err = io.Copy(tmp, r.body)
 	// read is being called by ToCacheable
 	// which will cache our response, let's not waste any space in the cache
 	r.bytes = make([]byte, tmp.Len())
 	copy(r.bytes, tmp.Bytes())
 }
 
+// Reads the body if it's no larger than max. When it's larger, what was
+// read is put back in front of the rest of the body
+func (r *StreamingResponse) readLimit(max int64) bool {
+	if r.bytes != nil {
+		return int64(len(r.bytes)) <= max
+	}
+	tmp := bytes.NewBuffer(make([]byte, 0, 65536))
+	n, err := io.Copy(tmp, io.LimitReader(r.body, max+1))
+	if err != nil || n > max {
+		r.err = err
+		r.body = &readAhead{Reader: io.MultiReader(bytes.NewReader(tmp.Bytes()), r.body), Closer: r.body}
+		return false
+	}
+	r.bytes = make([]byte, tmp.Len())
+	copy(r.bytes, tmp.Bytes())
+	return true
+}
+
 func (r *StreamingResponse) Close() {
 	r.body.Close()
 	r.body = nil
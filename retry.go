@@ -0,0 +1,110 @@
+package garnish
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"syscall"
+)
+
+// Conditions which can trigger a retry
+const (
+	RETRY_CONNECT = "connect"
+	RETRY_RESET   = "reset"
+)
+
+var (
+	DefaultRetryMethods    = []string{"GET", "HEAD", "OPTIONS"}
+	DefaultRetryConditions = []string{RETRY_CONNECT, RETRY_RESET, "502", "503", "504"}
+)
+
+// Decides whether a failed upstream request should be sent again
+// (to a different transport, when possible)
+type RetryPolicy struct {
+	sync.Mutex
+
+	// The maximum number of attempts, including the first one
+	Attempts int
+
+	// The methods which can be retried
+	Methods map[string]bool
+
+	// Retry when a connection couldn't be established
+	Connect bool
+
+	// Retry when the connection was reset or closed before a response
+	Reset bool
+
+	// The response statuses to retry on
+	Statuses map[int]bool
+
+	// The percentage of requests which can be retries. Each request
+	// adds Budget to a balance (capped), each retry takes 100 from it.
+	// 0 disables the budget
+	Budget int
+
+	balance int
+}
+
+// Whether requests with the given method can be retried
+func (p *RetryPolicy) Retryable(method string) bool {
+	return p.Attempts > 1 && p.Methods[method]
+}
+
+// Whether the outcome of an attempt warrants a retry
+func (p *RetryPolicy) ShouldRetry(res *http.Response, err error) bool {
+	if err == nil {
+		return p.Statuses[res.StatusCode]
+	}
+	if p.Connect {
+		var op *net.OpError
+		if errors.As(err, &op) && op.Op == "dial" {
+			return true
+		}
+	}
+	if p.Reset {
+		if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return true
+		}
+	}
+	return false
+}
+
+// Called once per request, grows the retry budget
+func (p *RetryPolicy) Deposit() {
+	if p.Budget <= 0 {
+		return
+	}
+	p.Lock()
+	p.balance += p.Budget
+	if max := p.maxBalance(); p.balance > max {
+		p.balance = max
+	}
+	p.Unlock()
+}
+
+// Called before each retry. Returns false when the budget is exhausted
+func (p *RetryPolicy) Withdraw() bool {
+	if p.Budget <= 0 {
+		return true
+	}
+	p.Lock()
+	defer p.Unlock()
+	if p.balance < 100 {
+		return false
+	}
+	p.balance -= 100
+	return true
+}
+
+// Lets a burst of retries through after a quiet period without
+// letting the balance grow forever
+func (p *RetryPolicy) maxBalance() int {
+	max := p.Budget * 100
+	if max < 100 {
+		return 100
+	}
+	return max
+}
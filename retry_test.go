@@ -0,0 +1,44 @@
+package garnish
+
+import (
+	"errors"
+	. "github.com/karlseguin/expect"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+)
+
+type RetryTests struct{}
+
+func Test_Retry(t *testing.T) {
+	Expectify(new(RetryTests), t)
+}
+
+func (_ RetryTests) RetryableMethods() {
+	p := &RetryPolicy{Attempts: 2, Methods: map[string]bool{"GET": true}}
+	Expect(p.Retryable("GET")).To.Equal(true)
+	Expect(p.Retryable("POST")).To.Equal(false)
+	p.Attempts = 1
+	Expect(p.Retryable("GET")).To.Equal(false)
+}
+
+func (_ RetryTests) RetriesOnConfiguredConditions() {
+	p := &RetryPolicy{Connect: true, Statuses: map[int]bool{503: true}}
+	Expect(p.ShouldRetry(&http.Response{StatusCode: 503}, nil)).To.Equal(true)
+	Expect(p.ShouldRetry(&http.Response{StatusCode: 500}, nil)).To.Equal(false)
+	Expect(p.ShouldRetry(nil, &net.OpError{Op: "dial", Err: errors.New("refused")})).To.Equal(true)
+	Expect(p.ShouldRetry(nil, io.ErrUnexpectedEOF)).To.Equal(false)
+	p.Reset = true
+	Expect(p.ShouldRetry(nil, io.ErrUnexpectedEOF)).To.Equal(true)
+}
+
+func (_ RetryTests) EnforcesTheBudget() {
+	p := &RetryPolicy{Budget: 20}
+	for i := 0; i < 10; i++ {
+		p.Deposit()
+	}
+	Expect(p.Withdraw()).To.Equal(true)
+	Expect(p.Withdraw()).To.Equal(true)
+	Expect(p.Withdraw()).To.Equal(false)
+}
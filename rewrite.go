@@ -0,0 +1,141 @@
+package garnish
+
+import (
+	"net/url"
+	"strings"
+)
+
+// Rules for changing a route's URL before it's sent to the upstream.
+// Applied in order: Path, StripPrefix, AddPrefix, then the query rules.
+type Rewrite struct {
+	// The route's path, used to find what the * wildcard captured
+	Pattern string
+
+	// Rebuilds the path from a template. Segments like :id are replaced with
+	// the route's params, and * with what the route's wildcard captured:
+	// /v2/user/:id/*
+	Path string
+
+	StripPrefix string
+	AddPrefix   string
+
+	// Query parameters to set (replacing any existing values). Values
+	// beginning with : are replaced with the route's params
+	SetQuery map[string]string
+
+	// Query parameters to remove
+	RemoveQuery []string
+
+	// Query parameters to rename (old name => new name)
+	RenameQuery map[string]string
+}
+
+// Returns the URL to send to the upstream. in isn't modified. The rules
+// work on the escaped path, so escapes like %2F are forwarded as-is
+func (rw *Rewrite) Apply(req *Request) *url.URL {
+	in := req.URL
+	path := in.EscapedPath()
+	if len(rw.Path) > 0 {
+		path = rw.expand(req)
+	}
+	if prefix := strings.TrimSuffix(rw.StripPrefix, "/"); len(prefix) > 0 {
+		// only whole segments: /api doesn't strip /apiary
+		if path == prefix || strings.HasPrefix(path, prefix+"/") {
+			if path = path[len(prefix):]; len(path) == 0 {
+				path = "/"
+			}
+		}
+	}
+	if len(rw.AddPrefix) > 0 {
+		path = strings.TrimSuffix(rw.AddPrefix, "/") + path
+	}
+
+	out := &url.URL{RawPath: path, RawQuery: in.RawQuery}
+	if unescaped, err := url.PathUnescape(path); err == nil {
+		out.Path = unescaped
+	} else {
+		out.Path, out.RawPath = path, ""
+	}
+
+	if len(rw.SetQuery) == 0 && len(rw.RemoveQuery) == 0 && len(rw.RenameQuery) == 0 {
+		return out
+	}
+	query := in.Query()
+	for _, key := range rw.RemoveQuery {
+		delete(query, key)
+	}
+	for from, to := range rw.RenameQuery {
+		if values, ok := query[from]; ok {
+			delete(query, from)
+			query[to] = values
+		}
+	}
+	for key, value := range rw.SetQuery {
+		if len(value) > 1 && value[0] == ':' {
+			value = req.Params(value[1:])
+		}
+		query.Set(key, value)
+	}
+	out.RawQuery = query.Encode()
+	return out
+}
+
+// Maps a path from the upstream (say, in a redirect) back to the client's,
+// by undoing AddPrefix and StripPrefix. Paths rebuilt from a template
+// can't be mapped back and are returned as-is. Safe to call on nil
+func (rw *Rewrite) Reverse(path string) string {
+	if rw == nil || len(rw.Path) > 0 {
+		return path
+	}
+	if len(rw.AddPrefix) > 0 {
+		prefix := strings.TrimSuffix(rw.AddPrefix, "/")
+		if path != prefix && strings.HasPrefix(path, prefix+"/") == false {
+			return path
+		}
+		if path = path[len(prefix):]; len(path) == 0 {
+			path = "/"
+		}
+	}
+	if len(rw.StripPrefix) > 0 {
+		path = strings.TrimSuffix(rw.StripPrefix, "/") + path
+	}
+	return path
+}
+
+// Returns an escaped path
+func (rw *Rewrite) expand(req *Request) string {
+	segments := strings.Split(rw.Path, "/")
+	for i, segment := range segments {
+		if segment == "*" {
+			segments[i] = wildcard(rw.Pattern, req.URL.EscapedPath())
+		} else if len(segment) > 1 && segment[0] == ':' {
+			segments[i] = url.PathEscape(req.Params(segment[1:]))
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// What a pattern's trailing * matched in path. Given /files/* and
+// /files/a/b.txt, returns a/b.txt
+func wildcard(pattern, path string) string {
+	if strings.HasSuffix(pattern, "*") == false {
+		return ""
+	}
+	ps := strings.Split(strings.TrimPrefix(pattern, "/"), "/")
+	rs := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	i := len(ps) - 1
+	if i >= len(rs) {
+		return ""
+	}
+	return strings.TrimPrefix(strings.Join(rs[i:], "/"), strings.TrimSuffix(ps[i], "*"))
+}
+
+// A CacheKeyLookup which uses the rewritten URL, so that different routes
+// which rewrite to the same upstream URL share cache entries
+func RewrittenCacheKeyLookup(req *Request) (string, string) {
+	u := req.UpstreamURL
+	if u == nil {
+		u = req.URL
+	}
+	return u.Path, u.RawQuery
+}
@@ -0,0 +1,56 @@
+package garnish
+
+import (
+	. "github.com/karlseguin/expect"
+	"github.com/karlseguin/expect/build"
+	"gopkg.in/karlseguin/params.v2"
+	"testing"
+)
+
+type RewriteTests struct{}
+
+func Test_Rewrite(t *testing.T) {
+	Expectify(new(RewriteTests), t)
+}
+
+func (_ RewriteTests) StripsAndAddsPrefixes() {
+	rw := &Rewrite{StripPrefix: "/api", AddPrefix: "/v2/"}
+	Expect(rw.Apply(NewRequest(build.Request().URLString("/api/users/3?a=1").Request, nil, params.New(0))).RequestURI()).To.Equal("/v2/users/3?a=1")
+	Expect(rw.Apply(NewRequest(build.Request().URLString("/api").Request, nil, params.New(0))).RequestURI()).To.Equal("/v2/")
+	Expect(rw.Apply(NewRequest(build.Request().URLString("/other").Request, nil, params.New(0))).RequestURI()).To.Equal("/v2/other")
+	Expect(rw.Apply(NewRequest(build.Request().URLString("/apiary").Request, nil, params.New(0))).RequestURI()).To.Equal("/v2/apiary")
+}
+
+func (_ RewriteTests) ExpandsTemplates() {
+	rw := &Rewrite{Pattern: "/api/users/:id/files/*", Path: "/v2/user/:id/*"}
+	req := NewRequest(build.Request().URLString("/api/users/3/files/a/b.txt").Request, nil, params.New(0))
+	req.params.Set("id", "3")
+	Expect(rw.Apply(req).Path).To.Equal("/v2/user/3/a/b.txt")
+}
+
+func (_ RewriteTests) EditsTheQuery() {
+	rw := &Rewrite{
+		RemoveQuery: []string{"debug"},
+		RenameQuery: map[string]string{"q": "query"},
+		SetQuery:    map[string]string{"v": "2", "user": ":id"},
+	}
+	req := NewRequest(build.Request().URLString("/search?q=dune&debug=1&v=1").Request, nil, params.New(0))
+	req.params.Set("id", "3")
+	Expect(rw.Apply(req).RawQuery).To.Equal("query=dune&user=3&v=2")
+	Expect(req.URL.RawQuery).To.Equal("q=dune&debug=1&v=1")
+}
+
+func (_ RewriteTests) CacheKeyCanUseTheRewrittenUrl() {
+	req := NewRequest(build.Request().URLString("/api/users?a=1").Request, nil, params.New(0))
+	req.UpstreamURL = (&Rewrite{StripPrefix: "/api"}).Apply(req)
+	path, query := RewrittenCacheKeyLookup(req)
+	Expect(path).To.Equal("/users")
+	Expect(query).To.Equal("a=1")
+}
+
+func (_ RewriteTests) KeepsEscapesInThePath() {
+	req := NewRequest(build.Request().URLString("/api/files/a%2Fb.txt").Request, nil, params.New(1).Set("name", "c/d.txt"))
+	Expect((&Rewrite{StripPrefix: "/api"}).Apply(req).RequestURI()).To.Equal("/files/a%2Fb.txt")
+	Expect((&Rewrite{Pattern: "/api/files/*", Path: "/v2/*"}).Apply(req).RequestURI()).To.Equal("/v2/a%2Fb.txt")
+	Expect((&Rewrite{Path: "/v2/:name"}).Apply(req).RequestURI()).To.Equal("/v2/c%2Fd.txt")
+}
@@ -12,11 +12,49 @@ type Route struct {
 	Cache       *RouteCache
 	StopHandler Handler
 	FlowHandler Middleware
+
+	// Overrides the upstream's total request timeout when > 0
+	Timeout time.Duration
+
+	// Override the upstream's connect and response header timeouts when > 0
+	ConnectTimeout time.Duration
+	HeaderTimeout  time.Duration
+
+	// Changes the URL sent to the upstream, nil to send it as-is
+	Rewrite *Rewrite
+
+	// Whether Upgrade (websocket) requests are proxied. When false, the
+	// Upgrade header is dropped and the request is treated like any other
+	WebSocket bool
+
+	// Upgraded connections which haven't seen any traffic for this long
+	// are closed. 0 disables the timeout
+	WebSocketIdle time.Duration
+
+	// Sends a copy of requests to another upstream, nil to disable
+	Mirror *Mirror
+
+	// Splits traffic between several upstreams (instead of Upstream)
+	Split *Split
+
+	// Rules applied to the headers of responses sent to the client (after
+	// the upstream's)
+	ResponseHeaders HeaderRules
+
+	// Maps upstream URLs in redirects and cookies back to the client's,
+	// nil to leave them as-is
+	ResponseURLs *ResponseURLs
+
+	// Size limits on requests and responses, nil for none
+	Limits *Limits
 }
 
 type RouteCache struct {
 	KeyLookup CacheKeyLookup
 	TTL       time.Duration
+
+	// The route's limits (for MaxCacheable), nil for none
+	Limits *Limits
 }
 
 func NewRouteCache(ttl time.Duration, keyLookup CacheKeyLookup) *RouteCache {
@@ -10,7 +10,10 @@ import (
 
 var (
 	UnauthorizedResponse = Empty(401)
-	fakeRequest          = &Request{Id: "fake"}
+	// Returned when the client goes away before the upstream responds
+	// (there's nobody to send it to, but it's what stats and logs see)
+	AbortedResponse = Empty(499)
+	fakeRequest     = &Request{Id: "fake"}
 )
 
 // Authorization / authentication handler
@@ -22,6 +25,7 @@ type Runtime struct {
 	Address          string
 	NotFoundResponse Response
 	FatalResponse    Response
+	TimeoutResponse  Response
 	Executor         Handler
 	Upstreams        map[string]Upstream
 	Routes           map[string]*Route
@@ -31,6 +35,26 @@ type Runtime struct {
 	Cache            *Cache
 	Resolver         *dnscache.Resolver
 	HydrateLoader    HydrateLoader
+	HealthCheckers   []*HealthChecker
+	Discoverers      []*Discoverer
+
+	// Returned when an upstream's circuit breaker is open
+	CircuitOpenResponse Response
+
+	// Returned when an upstream's concurrency limit (and queue) is full
+	OverloadedResponse Response
+
+	// Returned when a request's body is larger than its route allows
+	PayloadTooLargeResponse Response
+
+	// Raw TCP listeners, started alongside the http server
+	TCPProxies []*TCPProxy
+
+	// Upgraded (websocket) connections
+	Tunnels *Tunnels
+
+	// The forwarding headers sent to upstreams
+	Forwarding *Forwarding
 }
 
 func (r *Runtime) RegisterStats(name string, reporter Reporter) {
@@ -39,6 +63,19 @@ func (r *Runtime) RegisterStats(name string, reporter Reporter) {
 	}
 }
 
+// Stops reporting the stats registered under name
+func (r *Runtime) UnregisterStats(name string) {
+	if r.StatsWorker != nil {
+		r.StatsWorker.unregister(name)
+	}
+}
+
+// Whether the response represents a failure to get a response from
+// the upstream. Used by the cache to serve stale responses (saint mode)
+func (r *Runtime) IsFailure(res Response) bool {
+	return res == nil || res.Status() >= 500 || res == r.CircuitOpenResponse || res == r.OverloadedResponse
+}
+
 func (r *Runtime) ServeHTTP(out http.ResponseWriter, request *http.Request) {
 	req := r.route(request)
 	if req == nil {
@@ -48,6 +85,10 @@ func (r *Runtime) ServeHTTP(out http.ResponseWriter, request *http.Request) {
 	}
 	req.Infof("%s", req.URL)
 	defer req.Close()
+	if req.Route.Limits.Request(out, request) == false {
+		r.reply(out, req.TooLargeResponse(), req)
+		return
+	}
 	r.reply(out, r.Executor(req), req)
 }
 
@@ -56,6 +97,10 @@ func (r *Runtime) reply(out http.ResponseWriter, res Response, req *Request) {
 		Log.Error("nil response")
 		res = r.FatalResponse
 	}
+	if u, ok := res.(*UpgradeResponse); ok {
+		r.upgrade(out, u, req)
+		return
+	}
 
 	defer res.Close()
 	oh := out.Header()
@@ -71,6 +116,13 @@ func (r *Runtime) reply(out http.ResponseWriter, res Response, req *Request) {
 	if req.hit {
 		oh["X-Cache"] = hitHeaderValue
 	}
+	// applied to the copy in oh, so cached responses aren't changed
+	if req.Upstream != nil {
+		req.Upstream.ResponseHeaders().Apply(req, oh)
+	}
+	if req.Route != nil {
+		req.Route.ResponseHeaders.Apply(req, oh)
+	}
 	req.Infof("%d", status)
 	out.WriteHeader(status)
 	res.Write(r, out)
@@ -90,12 +142,62 @@ func (r *Runtime) route(req *http.Request) *Request {
 	return request
 }
 
+// Starts the runtime's health checks and discovery. Start and Reload call
+// this, so a runtime which is built but never used (say, a reload which
+// failed validation) doesn't leave them running
+func (r *Runtime) Activate() {
+	for _, h := range r.HealthCheckers {
+		go h.Run()
+	}
+	for _, d := range r.Discoverers {
+		go d.Run()
+	}
+}
+
 func (o *Runtime) ReplaceWith(n *Runtime) {
 	if o.StatsWorker != nil {
 		o.StatsWorker.Stop()
 	}
 	o.Resolver.Stop()
+	for _, h := range o.HealthCheckers {
+		h.Stop()
+	}
+	for _, d := range o.Discoverers {
+		d.Stop()
+	}
+	o.replaceTCPProxies(n)
+	if o.Tunnels != nil {
+		o.Tunnels.Close()
+	}
 	o.Cache.Storage.SetSize(n.Cache.Storage.GetSize())
 	n.Cache.Storage.Stop()
 	n.Cache.Storage = o.Cache.Storage
 }
+
+// New proxies take over the listener of the old proxy with the same name
+// and address. Old proxies which no longer exist are closed (before new
+// proxies start listening, in case they reuse an address)
+func (o *Runtime) replaceTCPProxies(n *Runtime) {
+	existing := make(map[string]*TCPProxy, len(o.TCPProxies))
+	for _, p := range o.TCPProxies {
+		existing[p.Name+" "+p.Address] = p
+	}
+	var fresh []*TCPProxy
+	for _, p := range n.TCPProxies {
+		key := p.Name + " " + p.Address
+		if old, ok := existing[key]; ok {
+			p.Takeover(old)
+			delete(existing, key)
+		} else {
+			fresh = append(fresh, p)
+		}
+	}
+	for _, p := range existing {
+		p.Close()
+	}
+	for _, p := range fresh {
+		if err := p.Listen(); err != nil {
+			Log.Errorf("tcp %s: %v", p.Name, err)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package garnish
+
+import (
+	"math/rand"
+	"net/http"
+)
+
+// One of the upstreams a split route sends traffic to
+type SplitTarget struct {
+	Name     string
+	Upstream Upstream
+	Weight   int
+
+	// The stats of the requests served by this target (set up by the
+	// stats middleware, nil when stats aren't enabled)
+	Stats *RouteStats
+}
+
+// Returns the value a request is assigned by. Requests with the same value
+// go to the same target, for as long as the weights don't change. An
+// empty value assigns the request randomly
+type SplitKey func(req *Request) string
+
+// Forces requests with a header (say, X-Canary: 1) to a target
+type SplitOverride struct {
+	Header string
+	// An empty value matches any value
+	Value  string
+	Target *SplitTarget
+}
+
+// Splits a route's traffic between upstreams by weight
+type Split struct {
+	Targets   []*SplitTarget
+	Sticky    SplitKey
+	Overrides []SplitOverride
+}
+
+// Picks the target for the request. Sticky assignment is stateless: the
+// key is hashed to a point in [0, 1) which falls into a target's share,
+// so it survives a reload. Changing a weight only moves the requests whose
+// point falls between a share's old and new boundaries.
+func (s *Split) Pick(req *Request) *SplitTarget {
+	for _, o := range s.Overrides {
+		if values, ok := req.Header[http.CanonicalHeaderKey(o.Header)]; ok {
+			if len(o.Value) == 0 || (len(values) > 0 && values[0] == o.Value) {
+				return o.Target
+			}
+		}
+	}
+
+	total := 0
+	for _, t := range s.Targets {
+		total += t.Weight
+	}
+	if total == 0 {
+		return s.Targets[0]
+	}
+
+	point := -1.0
+	if s.Sticky != nil {
+		if key := s.Sticky(req); len(key) > 0 {
+			point = float64(hash(key)%1000000) / 1000000
+		}
+	}
+	if point < 0 {
+		point = rand.Float64()
+	}
+
+	cumulative := 0
+	for _, t := range s.Targets {
+		cumulative += t.Weight
+		if point < float64(cumulative)/float64(total) {
+			return t
+		}
+	}
+	return s.Targets[len(s.Targets)-1]
+}
+
+// Assigns requests by the value of a cookie (such as a session id)
+func CookieSplitKey(name string) SplitKey {
+	return func(req *Request) string {
+		if cookie, err := req.Cookie(name); err == nil {
+			return cookie.Value
+		}
+		return ""
+	}
+}
+
+// Assigns requests by the value of a header (such as a user id set by
+// an authentication proxy)
+func HeaderSplitKey(name string) SplitKey {
+	return func(req *Request) string {
+		return req.Header.Get(name)
+	}
+}
+
+// Wraps a CacheKeyLookup so that each target's responses are cached
+// separately
+func SplitCacheKeyLookup(lookup CacheKeyLookup) CacheKeyLookup {
+	return func(req *Request) (string, string) {
+		primary, secondary := lookup(req)
+		if req.Target != nil {
+			secondary += "@" + req.Target.Name
+		}
+		return primary, secondary
+	}
+}
@@ -0,0 +1,47 @@
+package garnish
+
+import (
+	. "github.com/karlseguin/expect"
+	"github.com/karlseguin/expect/build"
+	"strconv"
+	"testing"
+)
+
+type SplitTests struct{}
+
+func Test_Split(t *testing.T) {
+	Expectify(new(SplitTests), t)
+}
+
+func (_ SplitTests) SplitsByWeight() {
+	split := &Split{Sticky: HeaderSplitKey("X-User"), Targets: []*SplitTarget{&SplitTarget{Name: "main", Weight: 75}, &SplitTarget{Name: "canary", Weight: 25}}}
+	counts := map[string]int{}
+	for i := 0; i < 10000; i++ {
+		counts[split.Pick(&Request{Request: build.Request().Request}).Name]++
+	}
+	Expect(counts["main"] > 7000 && counts["main"] < 8000).To.Equal(true)
+}
+
+func (_ SplitTests) OverridesForceATarget() {
+	split := &Split{Sticky: HeaderSplitKey("X-User"), Targets: []*SplitTarget{&SplitTarget{Name: "main", Weight: 100}, &SplitTarget{Name: "canary", Weight: 0}}}
+	split.Overrides = []SplitOverride{{Header: "x-canary", Value: "1", Target: split.Targets[1]}}
+	Expect(split.Pick(&Request{Request: build.Request().Header("X-Canary", "1").Request}).Name).To.Equal("canary")
+	Expect(split.Pick(&Request{Request: build.Request().Header("X-Canary", "0").Request}).Name).To.Equal("main")
+}
+
+func (_ SplitTests) StickyRequestsOnlyMoveTowardsAGrowingTarget() {
+	before := &Split{Sticky: HeaderSplitKey("X-User"), Targets: []*SplitTarget{&SplitTarget{Name: "main", Weight: 90}, &SplitTarget{Name: "canary", Weight: 10}}}
+	after := &Split{Sticky: HeaderSplitKey("X-User"), Targets: []*SplitTarget{&SplitTarget{Name: "main", Weight: 80}, &SplitTarget{Name: "canary", Weight: 20}}}
+	moved := 0
+	for i := 0; i < 1000; i++ {
+		req := &Request{Request: build.Request().Header("X-User", strconv.Itoa(i)).Request}
+		b, a := before.Pick(req).Name, after.Pick(req).Name
+		Expect(before.Pick(req).Name).To.Equal(b)
+		if b == "canary" {
+			Expect(a).To.Equal("canary")
+		} else if a == "canary" {
+			moved++
+		}
+	}
+	Expect(moved > 50 && moved < 150).To.Equal(true)
+}
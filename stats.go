@@ -47,12 +47,13 @@ type RouteStats struct {
 	failures int64
 	slow     int64
 	cached   int64
+	aborted  int64
 }
 
 func NewRouteStats(treshold time.Duration) *RouteStats {
 	return &RouteStats{
 		Treshold: treshold,
-		snapshot: make(Snapshot, 6+len(STATS_PERCENTILES)),
+		snapshot: make(Snapshot, 7+len(STATS_PERCENTILES)),
 		samplesA: make([]int, STATS_SAMPLE_SIZE),
 		samplesB: make([]int, STATS_SAMPLE_SIZE),
 	}
@@ -80,6 +81,11 @@ func (s *RouteStats) Hit(res Response, t time.Duration) {
 	}
 }
 
+// Called when the client went away before getting its response
+func (s *RouteStats) Abort() {
+	atomic.AddInt64(&s.aborted, 1)
+}
+
 func (s *RouteStats) sample(hits int64, t time.Duration) {
 	index := -1
 	sampleCount := atomic.LoadInt64(&s.sampleCount)
@@ -105,6 +111,7 @@ func (s *RouteStats) Snapshot() Snapshot {
 	s.snapshot["5xx"] = atomic.SwapInt64(&s.failures, 0)
 	s.snapshot["slow"] = atomic.SwapInt64(&s.slow, 0)
 	s.snapshot["cached"] = atomic.SwapInt64(&s.cached, 0)
+	s.snapshot["aborted"] = atomic.SwapInt64(&s.aborted, 0)
 	s.snapshot["hits"] = hits
 
 	s.sampleLock.Lock()
@@ -145,6 +152,7 @@ func percentile(values []int, p float64, size int) int64 {
 
 // Background worker that persists the stats every minute
 type StatsWorker struct {
+	sync.Mutex
 	fileName  string
 	routes    map[string]*Route
 	gcstats   *debug.GCStats
@@ -188,7 +196,11 @@ func (w *StatsWorker) Stop() {
 	w.stop <- struct{}{}
 }
 
+// Reporters can come and go (with discovered transports) while the
+// worker runs
 func (w *StatsWorker) register(name string, reporter Reporter) {
+	w.Lock()
+	defer w.Unlock()
 	if _, exists := w.reporters[name]; exists {
 		Log.Warnf("reporter with name %q was already registered.", name)
 		return
@@ -217,7 +229,15 @@ func (w *StatsWorker) collectRouteStats() map[string]Snapshot {
 	return routes
 }
 
+func (w *StatsWorker) unregister(name string) {
+	w.Lock()
+	delete(w.reporters, name)
+	w.Unlock()
+}
+
 func (w *StatsWorker) collectReporters() map[string]Snapshot {
+	w.Lock()
+	defer w.Unlock()
 	reporters := make(map[string]Snapshot)
 	for name, reporter := range w.reporters {
 		reporters[name] = reporter()
@@ -0,0 +1,255 @@
+package garnish
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Proxies raw byte streams (say, the redis protocol) accepted on Address to
+// one of Upstream's transports. Transports are picked, health checked and
+// ejected exactly like they are for http upstreams, but their address must
+// begin with tcp://
+type TCPProxy struct {
+	Name     string
+	Address  string
+	Upstream Upstream
+
+	// Connections which haven't seen any traffic (in either direction)
+	// for this long are closed. 0 disables the timeout
+	IdleTimeout time.Duration
+
+	// The maximum number of concurrent connections, additional connections
+	// are closed as soon as they're accepted. 0 for no limit
+	MaxConnections int64
+
+	listener *tcpListener
+	accepted int64
+	rejected int64
+	failed   int64
+	in       int64
+	out      int64
+}
+
+// The socket, and the connections accepted on it, survive a reload. The
+// listener always hands new connections to the latest proxy.
+type tcpListener struct {
+	sync.Mutex
+	net.Listener
+	proxy  atomic.Value
+	active int64
+	conns  map[net.Conn]struct{}
+	closed bool
+}
+
+// Starts listening on Address and serving connections in the background
+func (p *TCPProxy) Listen() error {
+	ln, err := net.Listen("tcp", p.Address)
+	if err != nil {
+		return err
+	}
+	p.listener = &tcpListener{Listener: ln, conns: make(map[net.Conn]struct{})}
+	p.listener.proxy.Store(p)
+	Log.Infof("tcp %s listening on %s", p.Name, p.Address)
+	go p.listener.serve()
+	return nil
+}
+
+// Takes over the socket (and active connections) of a proxy listening on
+// the same address. Used when reloading.
+func (p *TCPProxy) Takeover(old *TCPProxy) {
+	p.listener = old.listener
+	if p.listener != nil {
+		p.listener.proxy.Store(p)
+	}
+}
+
+// The address being listened on (useful when Address has a 0 port)
+func (p *TCPProxy) Addr() net.Addr {
+	if p.listener == nil {
+		return nil
+	}
+	return p.listener.Addr()
+}
+
+// Stops listening and closes every active connection
+func (p *TCPProxy) Close() {
+	l := p.listener
+	if l == nil {
+		return
+	}
+	l.Lock()
+	l.closed = true
+	for conn := range l.conns {
+		conn.Close()
+	}
+	l.Unlock()
+	l.Listener.Close()
+}
+
+func (p *TCPProxy) Stats() map[string]int64 {
+	stats := map[string]int64{
+		"accepted": atomic.SwapInt64(&p.accepted, 0),
+		"rejected": atomic.SwapInt64(&p.rejected, 0),
+		"failed":   atomic.SwapInt64(&p.failed, 0),
+		"in":       atomic.SwapInt64(&p.in, 0),
+		"out":      atomic.SwapInt64(&p.out, 0),
+	}
+	if p.listener != nil {
+		stats["active"] = atomic.LoadInt64(&p.listener.active)
+	}
+	return stats
+}
+
+func (l *tcpListener) serve() {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			l.Lock()
+			closed := l.closed
+			l.Unlock()
+			if closed || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			Log.Errorf("tcp accept: %v", err)
+			time.Sleep(time.Millisecond * 10)
+			continue
+		}
+		p := l.proxy.Load().(*TCPProxy)
+		atomic.AddInt64(&p.accepted, 1)
+		if p.MaxConnections > 0 && atomic.LoadInt64(&l.active) >= p.MaxConnections {
+			atomic.AddInt64(&p.rejected, 1)
+			conn.Close()
+			continue
+		}
+		if l.track(conn) == false {
+			return
+		}
+		atomic.AddInt64(&l.active, 1)
+		go p.handle(conn)
+	}
+}
+
+func (l *tcpListener) track(conn net.Conn) bool {
+	l.Lock()
+	defer l.Unlock()
+	if l.closed {
+		conn.Close()
+		return false
+	}
+	l.conns[conn] = struct{}{}
+	return true
+}
+
+func (l *tcpListener) untrack(conn net.Conn) {
+	l.Lock()
+	delete(l.conns, conn)
+	l.Unlock()
+}
+
+func (p *TCPProxy) handle(client net.Conn) {
+	l := p.listener
+	defer atomic.AddInt64(&l.active, -1)
+	defer l.untrack(client)
+	defer client.Close()
+
+	transport := p.Upstream.Transport(nil)
+	if transport == nil {
+		atomic.AddInt64(&p.failed, 1)
+		return
+	}
+	server, err := transport.Dial(context.Background())
+	p.Upstream.Report(transport, err == nil)
+	if err != nil {
+		atomic.AddInt64(&p.failed, 1)
+		Log.Errorf("tcp %s dial %s: %v", p.Name, transport.Address, err)
+		return
+	}
+	defer server.Close()
+	// so that leastoutstanding and p2c see long-lived connections
+	atomic.AddInt64(&transport.outstanding, 1)
+	defer atomic.AddInt64(&transport.outstanding, -1)
+
+	// closing the server connection on teardown unblocks the pipes
+	if l.track(server) == false {
+		return
+	}
+	defer l.untrack(server)
+
+	s := &tcpSession{idle: p.IdleTimeout, last: time.Now().UnixNano()}
+	done := make(chan struct{})
+	go func() {
+		s.pipe(server, client, &p.in)
+		close(done)
+	}()
+	s.pipe(client, server, &p.out)
+	<-done
+}
+
+type tcpSession struct {
+	idle time.Duration
+	last int64
+}
+
+// Copies from src to dst until src is done. The idle timeout considers
+// traffic in both directions, so a connection where only one side talks
+// isn't considered idle
+func (s *tcpSession) pipe(dst, src net.Conn, counter *int64) {
+	buffer := make([]byte, 32*1024)
+	for {
+		if s.idle > 0 {
+			src.SetReadDeadline(time.Now().Add(s.idle))
+		}
+		n, err := src.Read(buffer)
+		if n > 0 {
+			atomic.StoreInt64(&s.last, time.Now().UnixNano())
+			if _, err := dst.Write(buffer[:n]); err != nil {
+				src.Close()
+				return
+			}
+			atomic.AddInt64(counter, int64(n))
+		}
+		if err == nil {
+			continue
+		}
+		var ne net.Error
+		if errors.As(err, &ne) && ne.Timeout() {
+			if time.Since(time.Unix(0, atomic.LoadInt64(&s.last))) < s.idle {
+				continue
+			}
+			// idle, tear down both directions
+			dst.Close()
+			src.Close()
+			return
+		}
+		if errors.Is(err, io.EOF) {
+			// let the other direction finish
+			if tcp, ok := dst.(*net.TCPConn); ok {
+				tcp.CloseWrite()
+				return
+			}
+		}
+		dst.Close()
+		return
+	}
+}
+
+// Opens a raw connection to the transport (whose address must begin with
+// tcp://), going through the same dialer (dns cache, connect timeout)
+// as http requests
+func (t *Transport) Dial(ctx context.Context) (net.Conn, error) {
+	if strings.HasPrefix(t.Address, "tcp://") == false {
+		return nil, errors.New("transport " + t.Address + " isn't a tcp transport")
+	}
+	address := t.Address[6:]
+	if t.Transport != nil && t.Transport.DialContext != nil {
+		return t.Transport.DialContext(ctx, "tcp", address)
+	}
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "tcp", address)
+}
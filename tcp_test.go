@@ -0,0 +1,110 @@
+package garnish
+
+import (
+	"bufio"
+	. "github.com/karlseguin/expect"
+	"net"
+	"testing"
+	"time"
+)
+
+type TCPTests struct{}
+
+func Test_TCP(t *testing.T) {
+	Log = NewFakeLogger()
+	Expectify(new(TCPTests), t)
+}
+
+func (_ TCPTests) ProxiesBytes() {
+	p := testTCPProxy(0, 0)
+	defer p.Close()
+	conn := dialTCP(p)
+	defer conn.Close()
+	conn.Write([]byte("hello\n"))
+	line, _ := bufio.NewReader(conn).ReadString('\n')
+	Expect(line).To.Equal("hello\n")
+	Expect(p.Stats()["in"]).To.Equal(int64(6))
+}
+
+func (_ TCPTests) LimitsConnections() {
+	p := testTCPProxy(0, 1)
+	defer p.Close()
+	first := dialTCP(p)
+	defer first.Close()
+	first.Write([]byte("1\n"))
+	bufio.NewReader(first).ReadString('\n')
+
+	second := dialTCP(p)
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := second.Read(make([]byte, 1))
+	Expect(err == nil).To.Equal(false)
+	stats := p.Stats()
+	Expect(stats["rejected"]).To.Equal(int64(1))
+	Expect(stats["active"]).To.Equal(int64(1))
+}
+
+func (_ TCPTests) ClosesIdleConnections() {
+	p := testTCPProxy(time.Millisecond*20, 0)
+	defer p.Close()
+	conn := dialTCP(p)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	start := time.Now()
+	_, err := conn.Read(make([]byte, 1))
+	Expect(err == nil).To.Equal(false)
+	Expect(time.Since(start) < time.Millisecond*500).To.Equal(true)
+}
+
+func (_ TCPTests) TakesOverTheListener() {
+	old := testTCPProxy(0, 0)
+	defer old.Close()
+	p := &TCPProxy{Name: old.Name, Address: old.Address, Upstream: old.Upstream}
+	p.Takeover(old)
+	conn := dialTCP(p)
+	defer conn.Close()
+	conn.Write([]byte("hello\n"))
+	bufio.NewReader(conn).ReadString('\n')
+	Expect(p.Stats()["accepted"]).To.Equal(int64(1))
+	Expect(old.Stats()["accepted"]).To.Equal(int64(0))
+}
+
+func testTCPProxy(idle time.Duration, max int64) *TCPProxy {
+	echo, _ := net.Listen("tcp", "127.0.0.1:0")
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					conn.Write([]byte(line))
+				}
+			}()
+		}
+	}()
+	upstream, _ := CreateUpstream(&UpstreamConfig{
+		Name:       "echo",
+		Transports: []*Transport{&Transport{Address: "tcp://" + echo.Addr().String()}},
+	})
+	p := &TCPProxy{Name: "echo", Address: "127.0.0.1:0", Upstream: upstream, IdleTimeout: idle, MaxConnections: max}
+	if err := p.Listen(); err != nil {
+		panic(err)
+	}
+	return p
+}
+
+func dialTCP(p *TCPProxy) net.Conn {
+	conn, err := net.Dial("tcp", p.Addr().String())
+	if err != nil {
+		panic(err)
+	}
+	return conn
+}
@@ -1,16 +1,25 @@
 package garnish
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
 	"fmt"
 	. "github.com/karlseguin/expect"
 	"github.com/karlseguin/expect/build"
+	"gopkg.in/karlseguin/bytepool.v3"
 	"gopkg.in/karlseguin/garnish.v1"
 	"gopkg.in/karlseguin/garnish.v1/cache"
 	"gopkg.in/karlseguin/garnish.v1/middlewares"
 	"gopkg.in/karlseguin/router.v1"
 	"gopkg.in/karlseguin/typed.v1"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 )
@@ -128,6 +137,197 @@ func (r *RuntimeTests) CachesValues() {
 	Expect(out.HeaderMap.Get("X-Cache")).To.Equal("hit")
 }
 
+func (r *RuntimeTests) CachesVariants() {
+	runtime, req := r.h.Catch(func(req *garnish.Request) garnish.Response {
+		return garnish.RespondH(200, http.Header{"Vary": []string{"Accept-Language"}}, req.Header.Get("Accept-Language"))
+	}).Get("/cache")
+	runtime.Cache.Storage.DeleteAll("/cache")
+
+	for _, language := range []string{"en", "fr", "en"} {
+		req.Header.Set("Accept-Language", language)
+		out := httptest.NewRecorder()
+		runtime.ServeHTTP(out, req)
+		Expect(out.Body.String()).To.Equal(language)
+	}
+	req.Header.Del("Accept-Language")
+}
+
+func (r *RuntimeTests) AnswersConditionalRequestsFromTheCache() {
+	runtime, req := r.h.Catch(func(req *garnish.Request) garnish.Response {
+		return garnish.RespondH(200, http.Header{"Etag": []string{`"v1"`}}, "res")
+	}).Get("/cache")
+	runtime.Cache.Storage.DeleteAll("/cache")
+
+	runtime.ServeHTTP(httptest.NewRecorder(), req)
+	req.Header.Set("If-None-Match", `"v1"`)
+	out := httptest.NewRecorder()
+	runtime.ServeHTTP(out, req)
+	Expect(out.Code).To.Equal(304)
+	Expect(out.Body.Len()).To.Equal(0)
+	Expect(out.HeaderMap.Get("Etag")).To.Equal(`"v1"`)
+}
+
+func (r *RuntimeTests) ServesHeadFromTheCachedGet() {
+	runtime, req := r.h.Catch(func(req *garnish.Request) garnish.Response {
+		return garnish.Respond(200, "res")
+	}).Get("/cache")
+	runtime.Cache.Storage.DeleteAll("/cache")
+	runtime.ServeHTTP(httptest.NewRecorder(), req)
+
+	req.Method = "HEAD"
+	out := httptest.NewRecorder()
+	runtime.ServeHTTP(out, req)
+	Expect(out.Code).To.Equal(200)
+	Expect(out.HeaderMap.Get("X-Cache")).To.Equal("hit")
+	Expect(out.HeaderMap.Get("Content-Length")).To.Equal("3")
+	Expect(out.Body.Len()).To.Equal(0)
+}
+
+func (r *RuntimeTests) RevalidatesExpiredEntries() {
+	var conditional string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		conditional = req.Header.Get("If-None-Match")
+		w.Header().Set("Etag", `"v1"`)
+		w.Header().Set("Cache-Control", "max-age=30")
+		w.WriteHeader(304)
+	}))
+	defer server.Close()
+
+	runtime, req := r.h.Get("/cache")
+	route := runtime.Routes["cache"]
+	route.Upstream = testUpstream(server.URL)
+	defer func() { route.Upstream = nil }()
+	stale := garnish.RespondH(200, http.Header{"Etag": []string{`"v1"`}}, "cached").ToCacheable(time.Now().Add(-time.Hour))
+	runtime.Cache.Storage.Set("/cache", "", stale)
+
+	out := httptest.NewRecorder()
+	runtime.ServeHTTP(out, req)
+	Expect(conditional).To.Equal(`"v1"`)
+	Expect(out.Code).To.Equal(200)
+	Expect(out.Body.String()).To.Equal("cached")
+	Expect(out.HeaderMap.Get("Cache-Control")).To.Equal("max-age=30")
+	fresh := runtime.Cache.Storage.Get("/cache", "")
+	Expect(fresh.Expires().After(time.Now())).To.Equal(true)
+	Expect(stale.Expires().Before(time.Now())).To.Equal(true)
+}
+
+func (r *RuntimeTests) DoesNotSendGeneratedETagsUpstream() {
+	conditional := "unset"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		conditional = req.Header.Get("If-None-Match")
+		w.Header().Set("Cache-Control", "max-age=30")
+		w.Write([]byte("fresh"))
+	}))
+	defer server.Close()
+
+	runtime, req := r.h.Get("/cache")
+	req.URL.RawQuery = "etags"
+	route := runtime.Routes["cache"]
+	route.Upstream = testUpstream(server.URL)
+	runtime.Cache.ETags = true
+	defer func() { route.Upstream, runtime.Cache.ETags = nil, false }()
+
+	runtime.ServeHTTP(httptest.NewRecorder(), req)
+	item := runtime.Cache.Storage.Get("/cache", "etags")
+	Expect(len(item.Header().Get("Etag")) > 0).To.Equal(true)
+	Expect(garnish.GeneratedETag(item)).To.Equal(true)
+
+	item.Expire(time.Now().Add(-time.Hour))
+	out := httptest.NewRecorder()
+	runtime.ServeHTTP(out, req)
+	Expect(conditional).To.Equal("")
+	Expect(out.Body.String()).To.Equal("fresh")
+}
+
+func (r *RuntimeTests) AppliesResponseHeaderRules() {
+	runtime, req := r.h.Catch(func(req *garnish.Request) garnish.Response {
+		return garnish.RespondH(200, http.Header{"Server": []string{"internal"}}, "res")
+	}).Get("/headers")
+
+	out := httptest.NewRecorder()
+	runtime.ServeHTTP(out, req)
+	Expect(out.HeaderMap.Get("Server")).To.Equal("")
+	Expect(out.HeaderMap.Get("X-Cache-Status")).To.Equal("miss")
+
+	out = httptest.NewRecorder()
+	runtime.ServeHTTP(out, req)
+	Expect(out.HeaderMap.Get("Server")).To.Equal("")
+	Expect(out.HeaderMap.Get("X-Cache-Status")).To.Equal("hit")
+
+	cached := runtime.Cache.Storage.Get("/headers", "")
+	Expect(cached.Header().Get("Server")).To.Equal("internal")
+	Expect(cached.Header().Get("X-Cache-Status")).To.Equal("")
+}
+
+func (r *RuntimeTests) CompressesAndCachesTheVariant() {
+	body := strings.Repeat("compress me ", 20)
+	runtime, req := r.h.Catch(func(req *garnish.Request) garnish.Response {
+		return garnish.RespondH(200, http.Header{"Content-Type": []string{"text/plain"}}, body)
+	}).Get("/compress")
+	req.Header.Set("Accept-Encoding", "deflate;q=0.5, gzip")
+
+	for _, status := range []string{"", "hit"} {
+		out := httptest.NewRecorder()
+		runtime.ServeHTTP(out, req)
+		Expect(out.HeaderMap.Get("X-Cache")).To.Equal(status)
+		Expect(out.HeaderMap.Get("Content-Encoding")).To.Equal("gzip")
+		Expect(out.HeaderMap.Get("Vary")).To.Equal("Accept-Encoding")
+		zr, err := gzip.NewReader(out.Body)
+		Expect(err).To.Equal(nil)
+		plain, _ := io.ReadAll(zr)
+		Expect(string(plain)).To.Equal(body)
+	}
+
+	Expect(runtime.Cache.Storage.Get("/compress", "").Header().Get("Content-Encoding")).To.Equal("")
+	Expect(runtime.Cache.Storage.Get("/compress", "\x00gzip").Header().Get("Content-Encoding")).To.Equal("gzip")
+}
+
+func (r *RuntimeTests) CompressesDeflateWithZlib() {
+	body := strings.Repeat("compress me ", 20)
+	runtime, req := r.h.Catch(func(req *garnish.Request) garnish.Response {
+		return garnish.RespondH(200, http.Header{"Content-Type": []string{"text/plain"}}, body)
+	}).Get("/compress")
+	req.URL.RawQuery = "zlib"
+	req.Header.Set("Accept-Encoding", "deflate")
+
+	out := httptest.NewRecorder()
+	runtime.ServeHTTP(out, req)
+	Expect(out.HeaderMap.Get("Content-Encoding")).To.Equal("deflate")
+	zr, err := zlib.NewReader(out.Body)
+	Expect(err).To.Equal(nil)
+	plain, _ := io.ReadAll(zr)
+	Expect(string(plain)).To.Equal(body)
+}
+
+func (r *RuntimeTests) DoesNotCacheVariantsWhichFailToDecode() {
+	runtime, req := r.h.Catch(func(req *garnish.Request) garnish.Response {
+		return garnish.RespondH(200, http.Header{"Content-Type": []string{"text/plain"}, "Content-Encoding": []string{"gzip"}}, "not gzip")
+	}).Get("/compress")
+	req.URL.RawQuery = "broken"
+
+	runtime.ServeHTTP(httptest.NewRecorder(), req)
+	out := httptest.NewRecorder()
+	runtime.ServeHTTP(out, req)
+	Expect(out.Code).To.Equal(500)
+	Expect(runtime.Cache.Storage.Get("/compress", "broken\x00identity")).To.Equal(nil)
+}
+
+func (r *RuntimeTests) DecompressesForClientsWithoutGzip() {
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write([]byte("it was gzipped"))
+	zw.Close()
+	runtime, req := r.h.Catch(func(req *garnish.Request) garnish.Response {
+		return garnish.RespondH(200, http.Header{"Content-Type": []string{"application/octet-stream"}, "Content-Encoding": []string{"gzip"}}, compressed.Bytes())
+	}).Get("/nocache")
+
+	out := httptest.NewRecorder()
+	runtime.ServeHTTP(out, req)
+	Expect(out.HeaderMap.Get("Content-Encoding")).To.Equal("")
+	Expect(out.HeaderMap.Get("Vary")).To.Equal("Accept-Encoding")
+	Expect(out.Body.String()).To.Equal("it was gzipped")
+}
+
 func (r *RuntimeTests) SaintMode() {
 	called := false
 	runtime, req := r.h.Catch(func(req *garnish.Request) garnish.Response {
@@ -173,6 +373,31 @@ func (r *RuntimeTests) Purge() {
 	Expect(out.Code).To.Equal(200)
 }
 
+func (r *RuntimeTests) PurgesEveryTargetOfASplit() {
+	runtime, req := r.h.Get("/cache")
+	route := runtime.Routes["cache"]
+	route.Split = &garnish.Split{Targets: []*garnish.SplitTarget{
+		&garnish.SplitTarget{Name: "main", Weight: 1},
+		&garnish.SplitTarget{Name: "canary", Weight: 1},
+	}}
+	route.Cache.KeyLookup = garnish.SplitCacheKeyLookup(garnish.DefaultCacheKeyLookup)
+	defer func() {
+		route.Split, route.Cache.KeyLookup = nil, garnish.DefaultCacheKeyLookup
+	}()
+
+	storage := runtime.Cache.Storage
+	storage.Set("/cache", "split@main", garnish.Respond(200, "main").ToCacheable(time.Now().Add(time.Minute)))
+	storage.Set("/cache", "split@canary", garnish.Respond(200, "canary").ToCacheable(time.Now().Add(time.Minute)))
+
+	req.URL.RawQuery = "split"
+	req.Method = "PURGE"
+	out := httptest.NewRecorder()
+	runtime.ServeHTTP(out, req)
+	Expect(out.Code).To.Equal(200)
+	Expect(storage.Get("/cache", "split@main")).To.Equal(nil)
+	Expect(storage.Get("/cache", "split@canary")).To.Equal(nil)
+}
+
 func (r *RuntimeTests) Hydrate() {
 	runtime, req := r.h.Catch(func(req *garnish.Request) garnish.Response {
 		return garnish.RespondH(200, http.Header{"X-Hydrate": []string{"!ref"}}, hydrateBody)
@@ -213,6 +438,495 @@ func (r RuntimeTests) Dispatch() {
 	Expect(out.HeaderMap.Get("Dispatch")).To.Equal("out")
 }
 
+func (r RuntimeTests) UpstreamTimeout() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		time.Sleep(time.Millisecond * 50)
+	}))
+	defer server.Close()
+
+	runtime, req := r.h.Get("/timeout")
+	runtime.Routes["timeout"].Upstream = testUpstream(server.URL)
+	out := httptest.NewRecorder()
+	runtime.ServeHTTP(out, req)
+	Expect(out.Code).To.Equal(504)
+}
+
+func (r RuntimeTests) RoutesOverrideTheHeaderTimeout() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		time.Sleep(time.Millisecond * 50)
+		w.Write([]byte("slow"))
+	}))
+	defer server.Close()
+
+	runtime, req := r.h.Get("/upstream")
+	route := runtime.Routes["upstream"]
+	route.Upstream, _ = garnish.CreateUpstream(&garnish.UpstreamConfig{
+		Transports: []*garnish.Transport{&garnish.Transport{Transport: new(http.Transport), Address: server.URL, HeaderTimeout: time.Millisecond * 10}},
+	})
+	defer func() { route.Upstream, route.HeaderTimeout = nil, 0 }()
+
+	out := httptest.NewRecorder()
+	runtime.ServeHTTP(out, req)
+	Expect(out.Code).To.Equal(504)
+
+	route.HeaderTimeout = time.Second
+	out = httptest.NewRecorder()
+	runtime.ServeHTTP(out, req)
+	Expect(out.Code).To.Equal(200)
+	Expect(out.Body.String()).To.Equal("slow")
+}
+
+func (r RuntimeTests) CancelsTheUpstreamWhenTheClientAborts() {
+	cancelled := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case <-req.Context().Done():
+			close(cancelled)
+		case <-time.After(time.Second):
+		}
+	}))
+	defer server.Close()
+
+	runtime, req := r.h.Get("/upstream")
+	runtime.Routes["upstream"].Upstream = testUpstream(server.URL)
+	ctx, cancel := context.WithCancel(req.Context())
+	time.AfterFunc(time.Millisecond*20, cancel)
+	out := httptest.NewRecorder()
+	runtime.ServeHTTP(out, req.WithContext(ctx))
+	Expect(out.Code).To.Equal(499)
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		Fail("upstream request wasn't cancelled")
+	}
+	Expect(runtime.Routes["upstream"].Stats.Snapshot()["aborted"]).To.Equal(int64(1))
+}
+
+func (r RuntimeTests) AbortsDontCountAgainstTheUpstream() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case <-req.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer server.Close()
+
+	breaker := &garnish.CircuitBreaker{Name: "test", FailureRate: 0.5, MinRequests: 1, Window: time.Minute, Open: time.Minute, HalfOpen: 1}
+	transport := &garnish.Transport{Transport: new(http.Transport), Address: server.URL}
+	transport.Breaker = &garnish.CircuitBreaker{Name: "transport", FailureRate: 0.5, MinRequests: 1, Window: time.Minute, Open: time.Minute, HalfOpen: 1}
+	upstream, _ := garnish.CreateUpstream(&garnish.UpstreamConfig{
+		Breaker:    breaker,
+		Transports: []*garnish.Transport{transport},
+	})
+	runtime, req := r.h.Get("/upstream")
+	runtime.Routes["upstream"].Upstream = upstream
+	defer func() { runtime.Routes["upstream"].Upstream = nil }()
+
+	ctx, cancel := context.WithCancel(req.Context())
+	time.AfterFunc(time.Millisecond*10, cancel)
+	out := httptest.NewRecorder()
+	runtime.ServeHTTP(out, req.WithContext(ctx))
+	Expect(out.Code).To.Equal(499)
+	Expect(breaker.State()).To.Equal(garnish.CIRCUIT_CLOSED)
+	Expect(transport.Breaker.State()).To.Equal(garnish.CIRCUIT_CLOSED)
+}
+
+func (r RuntimeTests) RejectsLargeRequestBodies() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.Copy(io.Discard, req.Body)
+	}))
+	defer server.Close()
+
+	runtime, _ := r.h.Get("/upstream")
+	route := runtime.Routes["upstream"]
+	route.Upstream = testUpstream(server.URL)
+	route.Limits = &garnish.Limits{MaxRequestBody: 5}
+	runtime.PayloadTooLargeResponse = garnish.Empty(413)
+	defer func() { route.Limits = nil }()
+
+	for _, length := range []int64{11, -1} {
+		req := httptest.NewRequest("GET", "/upstream", strings.NewReader("hello world"))
+		req.ContentLength = length
+		out := httptest.NewRecorder()
+		runtime.ServeHTTP(out, req)
+		Expect(out.Code).To.Equal(413)
+	}
+	Expect(route.Limits.Stats()["rejected"]).To.Equal(int64(2))
+}
+
+func (r RuntimeTests) LargeRequestBodiesDontCountAgainstTheUpstream() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.Copy(io.Discard, req.Body)
+	}))
+	defer server.Close()
+
+	breaker := &garnish.CircuitBreaker{Name: "test", FailureRate: 0.5, MinRequests: 1, Window: time.Minute, Open: time.Minute, HalfOpen: 1}
+	transport := &garnish.Transport{Transport: new(http.Transport), Address: server.URL}
+	transport.Breaker = &garnish.CircuitBreaker{Name: "transport", FailureRate: 0.5, MinRequests: 1, Window: time.Minute, Open: time.Minute, HalfOpen: 1}
+	upstream, _ := garnish.CreateUpstream(&garnish.UpstreamConfig{
+		Breaker:    breaker,
+		Transports: []*garnish.Transport{transport},
+	})
+	runtime, _ := r.h.Get("/upstream")
+	route := runtime.Routes["upstream"]
+	route.Upstream = upstream
+	route.Limits = &garnish.Limits{MaxRequestBody: 5}
+	runtime.PayloadTooLargeResponse = garnish.Empty(413)
+	defer func() { route.Upstream, route.Limits = nil, nil }()
+
+	// without a Content-Length, the limit is only hit while streaming it upstream
+	req := httptest.NewRequest("GET", "/upstream", strings.NewReader(strings.Repeat("hello world", 10000)))
+	req.ContentLength = -1
+	out := httptest.NewRecorder()
+	runtime.ServeHTTP(out, req)
+	Expect(out.Code).To.Equal(413)
+	Expect(breaker.State()).To.Equal(garnish.CIRCUIT_CLOSED)
+	Expect(transport.Breaker.State()).To.Equal(garnish.CIRCUIT_CLOSED)
+}
+
+func (r RuntimeTests) RejectsLargeUpstreamResponses() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello world"))
+	}))
+	defer server.Close()
+
+	runtime, req := r.h.Get("/upstream")
+	route := runtime.Routes["upstream"]
+	route.Upstream = testUpstream(server.URL)
+	route.Limits = &garnish.Limits{MaxResponse: 5}
+	defer func() { route.Limits = nil }()
+
+	out := httptest.NewRecorder()
+	runtime.ServeHTTP(out, req)
+	Expect(out.Code).To.Equal(500)
+	Expect(route.Limits.Stats()["oversized"]).To.Equal(int64(1))
+}
+
+func (r RuntimeTests) TruncatesLargeChunkedUpstreamResponses() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+		w.(http.Flusher).Flush()
+		w.Write([]byte(" world"))
+	}))
+	defer server.Close()
+
+	runtime, req := r.h.Get("/upstream")
+	route := runtime.Routes["upstream"]
+	route.Upstream = testUpstream(server.URL)
+	route.Limits = &garnish.Limits{MaxResponse: 5}
+	defer func() { route.Limits = nil }()
+
+	out := httptest.NewRecorder()
+	runtime.ServeHTTP(out, req)
+	Expect(out.Code).To.Equal(200)
+	Expect(out.Body.String()).To.Equal("hello")
+	Expect(route.Limits.Stats()["truncated"]).To.Equal(int64(1))
+}
+
+func (r RuntimeTests) RetriesOnAnotherTransport() {
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(503)
+	}))
+	defer bad.Close()
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer good.Close()
+
+	upstream, _ := garnish.CreateUpstream(&garnish.UpstreamConfig{
+		Balancer: new(garnish.RoundRobinBalancer),
+		Retry: &garnish.RetryPolicy{
+			Attempts: 2,
+			Methods:  map[string]bool{"GET": true},
+			Statuses: map[int]bool{503: true},
+		},
+		Transports: []*garnish.Transport{
+			&garnish.Transport{Transport: new(http.Transport), Address: bad.URL},
+			&garnish.Transport{Transport: new(http.Transport), Address: good.URL},
+		},
+	})
+	runtime, req := r.h.Get("/upstream")
+	runtime.Routes["upstream"].Upstream = upstream
+	for i := 0; i < 4; i++ {
+		out := httptest.NewRecorder()
+		runtime.ServeHTTP(out, req)
+		Expect(out.Code).To.Equal(200)
+		Expect(out.Body.String()).To.Equal("ok")
+	}
+}
+
+func (r RuntimeTests) StopsRetryingWhenNoTransportsAreLeft() {
+	var upstream garnish.Upstream
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// what discovery does when every endpoint goes away
+		upstream.(*garnish.MultiTransportUpstream).SetTransports(nil)
+		w.WriteHeader(503)
+	}))
+	defer server.Close()
+
+	upstream, _ = garnish.CreateUpstream(&garnish.UpstreamConfig{
+		Retry: &garnish.RetryPolicy{
+			Attempts: 2,
+			Methods:  map[string]bool{"GET": true},
+			Statuses: map[int]bool{503: true},
+		},
+		Transports: []*garnish.Transport{
+			&garnish.Transport{Transport: new(http.Transport), Address: server.URL},
+			&garnish.Transport{Transport: new(http.Transport), Address: server.URL},
+		},
+	})
+	runtime, req := r.h.Get("/upstream")
+	runtime.Routes["upstream"].Upstream = upstream
+	defer func() { runtime.Routes["upstream"].Upstream = nil }()
+	out := httptest.NewRecorder()
+	runtime.ServeHTTP(out, req)
+	Expect(out.Code).To.Equal(503)
+}
+
+func (r RuntimeTests) RetriesCountOnceTowardsTheUpstreamBreaker() {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if calls++; calls == 1 {
+			w.WriteHeader(503)
+		}
+	}))
+	defer server.Close()
+
+	breaker := &garnish.CircuitBreaker{Name: "test", FailureRate: 0.5, MinRequests: 1, Window: time.Minute, Open: time.Millisecond, HalfOpen: 2}
+	breaker.Allow()
+	breaker.Record(false)
+	time.Sleep(time.Millisecond * 2)
+
+	upstream, _ := garnish.CreateUpstream(&garnish.UpstreamConfig{
+		Breaker: breaker,
+		Retry: &garnish.RetryPolicy{
+			Attempts: 2,
+			Methods:  map[string]bool{"GET": true},
+			Statuses: map[int]bool{503: true},
+		},
+		Transports: []*garnish.Transport{
+			&garnish.Transport{Transport: new(http.Transport), Address: server.URL},
+			&garnish.Transport{Transport: new(http.Transport), Address: server.URL},
+		},
+	})
+	runtime, req := r.h.Get("/upstream")
+	runtime.Routes["upstream"].Upstream = upstream
+	defer func() { runtime.Routes["upstream"].Upstream = nil }()
+
+	out := httptest.NewRecorder()
+	runtime.ServeHTTP(out, req)
+	Expect(out.Code).To.Equal(200)
+	Expect(calls).To.Equal(2)
+	Expect(breaker.State()).To.Equal(garnish.CIRCUIT_HALF_OPEN)
+}
+
+func (r RuntimeTests) RewritesTheUpstreamUrl() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(req.URL.RequestURI()))
+	}))
+	defer server.Close()
+
+	runtime, req := r.h.Get("/upstream")
+	route := runtime.Routes["upstream"]
+	route.Upstream = testUpstream(server.URL)
+	route.Rewrite = &garnish.Rewrite{AddPrefix: "/v2", SetQuery: map[string]string{"source": "garnish"}}
+	defer func() { route.Rewrite = nil }()
+	out := httptest.NewRecorder()
+	runtime.ServeHTTP(out, req)
+	Expect(out.Body.String()).To.Equal("/v2/upstream?source=garnish")
+}
+
+func (r RuntimeTests) DropsHeadersTheClientListsInConnection() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(req.Header.Get("X-Secret") + "|" + req.Header.Get("X-Token")))
+	}))
+	defer server.Close()
+
+	upstream, _ := garnish.CreateUpstream(&garnish.UpstreamConfig{
+		Headers:    []string{"X-Secret", "X-Token"},
+		Transports: []*garnish.Transport{&garnish.Transport{Transport: new(http.Transport), Address: server.URL}},
+	})
+	runtime, req := r.h.Get("/upstream")
+	runtime.Routes["upstream"].Upstream = upstream
+	defer func() { runtime.Routes["upstream"].Upstream = nil }()
+	req.Header.Set("Connection", "keep-alive, X-Secret")
+	req.Header.Set("X-Secret", "1")
+	req.Header.Set("X-Token", "2")
+	out := httptest.NewRecorder()
+	runtime.ServeHTTP(out, req)
+	Expect(out.Body.String()).To.Equal("|2")
+}
+
+func (r RuntimeTests) RelaysUpgradedConnections() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Upgrade") != "echo" {
+			w.WriteHeader(400)
+			return
+		}
+		conn, rw, _ := w.(http.Hijacker).Hijack()
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		rw.Flush()
+		io.Copy(conn, rw)
+	}))
+	defer server.Close()
+
+	runtime, _ := r.h.Get("/websocket")
+	runtime.Routes["websocket"].Upstream = testUpstream(server.URL)
+	proxy := httptest.NewServer(runtime)
+	defer proxy.Close()
+
+	conn, _ := net.Dial("tcp", proxy.Listener.Addr().String())
+	defer conn.Close()
+	conn.Write([]byte("GET /websocket HTTP/1.1\r\nHost: test\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n"))
+	reader := bufio.NewReader(conn)
+	res, _ := http.ReadResponse(reader, nil)
+	Expect(res.StatusCode).To.Equal(101)
+	Expect(res.Header.Get("Upgrade")).To.Equal("echo")
+
+	conn.Write([]byte("over the wire"))
+	buffer := make([]byte, 13)
+	io.ReadFull(reader, buffer)
+	Expect(string(buffer)).To.Equal("over the wire")
+	Expect(runtime.Tunnels.Stats()["active"]).To.Equal(int64(1))
+
+	// what a reload does to the old runtime
+	tunnels := runtime.Tunnels
+	defer func() { runtime.Tunnels = garnish.NewTunnels() }()
+	tunnels.Close()
+	_, err := reader.ReadByte()
+	Expect(err).To.Equal(io.EOF)
+}
+
+func (r RuntimeTests) UpgradedConnectionsOutliveTheServerTimeouts() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		conn, rw, _ := w.(http.Hijacker).Hijack()
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		rw.Flush()
+		io.Copy(conn, rw)
+	}))
+	defer server.Close()
+
+	runtime, _ := r.h.Get("/websocket")
+	runtime.Routes["websocket"].Upstream = testUpstream(server.URL)
+	proxy := httptest.NewUnstartedServer(runtime)
+	proxy.Config.ReadTimeout = time.Millisecond * 20
+	proxy.Config.WriteTimeout = time.Millisecond * 20
+	proxy.Start()
+	defer proxy.Close()
+
+	conn, _ := net.Dial("tcp", proxy.Listener.Addr().String())
+	defer conn.Close()
+	conn.Write([]byte("GET /websocket HTTP/1.1\r\nHost: test\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n"))
+	reader := bufio.NewReader(conn)
+	res, _ := http.ReadResponse(reader, nil)
+	Expect(res.StatusCode).To.Equal(101)
+
+	time.Sleep(time.Millisecond * 50)
+	conn.Write([]byte("still open"))
+	buffer := make([]byte, 10)
+	io.ReadFull(reader, buffer)
+	Expect(string(buffer)).To.Equal("still open")
+}
+
+func (r RuntimeTests) MirrorsRequests() {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("v1"))
+	}))
+	defer primary.Close()
+	bodies := make(chan string, 1)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		b, _ := io.ReadAll(req.Body)
+		bodies <- string(b)
+		w.Write([]byte("v2"))
+	}))
+	defer shadow.Close()
+
+	runtime, _ := r.h.Get("/upstream")
+	runtime.BytePool = bytepool.New(1024, 1)
+	route := runtime.Routes["upstream"]
+	route.Upstream = testUpstream(primary.URL)
+	route.Mirror = &garnish.Mirror{Name: "shadow", Upstream: testUpstream(shadow.URL), Percent: 100, Diff: true}
+	defer func() { route.Mirror = nil }()
+
+	req := build.Request().Path("/upstream").Body("over 9000").Request
+	out := httptest.NewRecorder()
+	runtime.ServeHTTP(out, req)
+	Expect(out.Body.String()).To.Equal("v1")
+	Expect(<-bodies).To.Equal("over 9000")
+	diffs := int64(0)
+	for stats := route.Mirror.Stats(); ; stats = route.Mirror.Stats() {
+		diffs += stats["diffs"]
+		if stats["inflight"] == 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	Expect(diffs).To.Equal(int64(1))
+}
+
+func (r RuntimeTests) MirrorsDontDiffAFailedPrimary() {
+	primary := httptest.NewServer(http.NotFoundHandler())
+	primary.Close()
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("v2"))
+	}))
+	defer shadow.Close()
+
+	runtime, req := r.h.Get("/upstream")
+	route := runtime.Routes["upstream"]
+	route.Upstream = testUpstream(primary.URL)
+	route.Mirror = &garnish.Mirror{Name: "shadow", Upstream: testUpstream(shadow.URL), Percent: 100, Diff: true}
+	defer func() { route.Mirror = nil }()
+
+	out := httptest.NewRecorder()
+	runtime.ServeHTTP(out, req)
+	Expect(out.Code).To.Equal(500)
+	sent, diffs := int64(0), int64(0)
+	for stats := route.Mirror.Stats(); ; stats = route.Mirror.Stats() {
+		sent, diffs = sent+stats["sent"], diffs+stats["diffs"]
+		if stats["inflight"] == 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	Expect(sent).To.Equal(int64(1))
+	Expect(diffs).To.Equal(int64(0))
+}
+
+func (r RuntimeTests) MirrorsCompareTheStreamedBody() {
+	body := strings.Repeat("over 9000 ", 1000)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(body))
+	})
+	primary := httptest.NewServer(handler)
+	defer primary.Close()
+	shadow := httptest.NewServer(handler)
+	defer shadow.Close()
+
+	runtime, req := r.h.Get("/upstream")
+	route := runtime.Routes["upstream"]
+	route.Upstream = testUpstream(primary.URL)
+	route.Mirror = &garnish.Mirror{Name: "shadow", Upstream: testUpstream(shadow.URL), Percent: 100, Diff: true}
+	defer func() { route.Mirror = nil }()
+
+	out := httptest.NewRecorder()
+	runtime.ServeHTTP(out, req)
+	Expect(out.Body.String()).To.Equal(body)
+	sent, diffs := int64(0), int64(0)
+	for stats := route.Mirror.Stats(); ; stats = route.Mirror.Stats() {
+		sent, diffs = sent+stats["sent"], diffs+stats["diffs"]
+		if stats["inflight"] == 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	Expect(sent).To.Equal(int64(1))
+	Expect(diffs).To.Equal(int64(0))
+}
+
 func assertHydrate(out *httptest.ResponseRecorder) {
 	Expect(out.Code).To.Equal(200)
 	b, _ := typed.Json(out.Body.Bytes())
@@ -245,22 +959,31 @@ func helper() *RuntimeHelper {
 	r := router.New(router.Configure())
 	r.AddNamed("cache", "GET", "/cache", nil)
 	r.AddNamed("cache", "PURGE", "/cache", nil)
+	r.AddNamed("cache", "HEAD", "/cache", nil)
 	r.AddNamed("hcache", "GET", "/hcache", nil)
 	r.AddNamed("nocache", "GET", "/nocache", nil)
 	r.AddNamed("control", "GET", "/control", nil)
 	r.AddNamed("dispatch", "GET", "/dispatch", nil)
+	r.AddNamed("timeout", "GET", "/timeout", nil)
+	r.AddNamed("upstream", "GET", "/upstream", nil)
+	r.AddNamed("websocket", "GET", "/websocket", nil)
+	r.AddNamed("headers", "GET", "/headers", nil)
+	r.AddNamed("compress", "GET", "/compress", nil)
 
 	hydr := &middlewares.Hydrate{Header: "X-Hydrate"}
+	cmpr := &middlewares.Compress{MinSize: 10, Types: []string{"text/"}, Level: -1, CacheVariants: true}
 
 	e := garnish.WrapMiddleware("upst", middlewares.Upstream, nil)
 	e = garnish.WrapMiddleware("dspt", middlewares.Dispatch, e)
 	e = garnish.WrapMiddleware("hydr", hydr.Handle, e)
 	e = garnish.WrapMiddleware("cach", middlewares.Cache, e)
+	e = garnish.WrapMiddleware("cmpr", cmpr.Handle, e)
 	e = garnish.WrapMiddleware("stat", middlewares.Stats, e)
 	runtime := &garnish.Runtime{
 		Router:           r,
 		Executor:         e,
 		FatalResponse:    garnish.Empty(500),
+		TimeoutResponse:  garnish.Empty(504),
 		NotFoundResponse: garnish.Empty(404),
 		Routes: map[string]*garnish.Route{
 			"cache": &garnish.Route{
@@ -292,7 +1015,34 @@ func helper() *RuntimeHelper {
 					return res
 				},
 			},
+			"timeout": &garnish.Route{
+				Stats:   garnish.NewRouteStats(time.Millisecond * 100),
+				Cache:   garnish.NewRouteCache(time.Duration(-1), nil),
+				Timeout: time.Millisecond * 10,
+			},
+			"upstream": &garnish.Route{
+				Stats: garnish.NewRouteStats(time.Millisecond * 100),
+				Cache: garnish.NewRouteCache(time.Duration(-1), nil),
+			},
+			"headers": &garnish.Route{
+				Stats: garnish.NewRouteStats(time.Millisecond * 100),
+				Cache: garnish.NewRouteCache(time.Minute, garnish.DefaultCacheKeyLookup),
+				ResponseHeaders: garnish.HeaderRules{
+					{Op: garnish.RemoveHeader, Name: "Server"},
+					{Op: garnish.SetHeader, Name: "X-Cache-Status", Value: "{cache.status}"},
+				},
+			},
+			"compress": &garnish.Route{
+				Stats: garnish.NewRouteStats(time.Millisecond * 100),
+				Cache: garnish.NewRouteCache(time.Minute, garnish.DefaultCacheKeyLookup),
+			},
+			"websocket": &garnish.Route{
+				Stats:     garnish.NewRouteStats(time.Millisecond * 100),
+				Cache:     garnish.NewRouteCache(time.Minute, nil),
+				WebSocket: true,
+			},
 		},
+		Tunnels: garnish.NewTunnels(),
 	}
 
 	runtime.Cache = garnish.NewCache()
@@ -313,6 +1063,13 @@ func helper() *RuntimeHelper {
 	}
 }
 
+func testUpstream(address string) garnish.Upstream {
+	upstream, _ := garnish.CreateUpstream(&garnish.UpstreamConfig{
+		Transports: []*garnish.Transport{&garnish.Transport{Transport: new(http.Transport), Address: address}},
+	})
+	return upstream
+}
+
 func (r *RuntimeHelper) Catch(catch garnish.Handler) *RuntimeHelper {
 	middlewares.Catch = catch
 	return r
@@ -1,9 +1,12 @@
 package garnish
 
 import (
-	"math/rand"
+	"context"
+	"io"
 	"net/http"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // The User Agent to send to the upstream
@@ -14,32 +17,95 @@ type RequestTweaker func(in *Request, out *http.Request)
 
 type Upstream interface {
 	Headers() []string
-	Transport() *Transport
 	Tweaker() RequestTweaker
+
+	// Picks a transport for the request, avoiding those in exclude when
+	// possible. req can be nil.
+	Transport(req *Request, exclude ...*Transport) *Transport
+	Transports() []*Transport
+
+	// nil when failed requests shouldn't be retried
+	RetryPolicy() *RetryPolicy
+
+	// nil when the upstream doesn't have a circuit breaker
+	Breaker() *CircuitBreaker
+
+	// nil when the upstream's concurrency isn't limited
+	Limiter() *ConcurrencyLimiter
+
+	// Rules applied to the headers of responses sent to the client
+	ResponseHeaders() HeaderRules
+
+	// Reports the outcome of a request sent to transport. ok is false
+	// for connection errors, timeouts and 5xx responses. Records the
+	// transport's breaker but not the upstream's, which is recorded once
+	// per request by whoever called its Allow
+	Report(transport *Transport, ok bool)
 }
 
-func CreateUpstream(headers []string, tweaker RequestTweaker, transports []*Transport) (Upstream, error) {
+// The pieces an upstream is made of
+type UpstreamConfig struct {
+	Name       string
+	Headers    []string
+	Tweaker    RequestTweaker
+	Balancer   Balancer
+	Outliers   *OutlierDetection
+	Retry      *RetryPolicy
+	Breaker    *CircuitBreaker
+	Limiter    *ConcurrencyLimiter
+	Transports []*Transport
+
+	ResponseHeaders HeaderRules
+
+	// The transports will change over time (discovery). Always creates
+	// a MultiTransportUpstream
+	Dynamic bool
+}
+
+func CreateUpstream(config *UpstreamConfig) (Upstream, error) {
 	var upstream Upstream
-	if len(transports) == 1 {
+	if len(config.Transports) == 1 && config.Dynamic == false {
 		upstream = &SingleTransportUpstream{
-			headers:   headers,
-			tweaker:   tweaker,
-			transport: transports[0],
+			headers:         config.Headers,
+			tweaker:         config.Tweaker,
+			retry:           config.Retry,
+			breaker:         config.Breaker,
+			limiter:         config.Limiter,
+			transport:       config.Transports[0],
+			responseHeaders: config.ResponseHeaders,
 		}
 	} else {
+		balancer := config.Balancer
+		if balancer == nil {
+			balancer = RandomBalancer{}
+		}
+		if aware, ok := balancer.(TransportAware); ok {
+			aware.SetTransports(config.Transports)
+		}
 		upstream = &MultiTransportUpstream{
-			headers:    headers,
-			tweaker:    tweaker,
-			transports: transports,
+			name:            config.Name,
+			headers:         config.Headers,
+			tweaker:         config.Tweaker,
+			balancer:        balancer,
+			outliers:        config.Outliers,
+			retry:           config.Retry,
+			breaker:         config.Breaker,
+			limiter:         config.Limiter,
+			transports:      config.Transports,
+			responseHeaders: config.ResponseHeaders,
 		}
 	}
 	return upstream, nil
 }
 
 type SingleTransportUpstream struct {
-	transport *Transport
-	headers   []string
-	tweaker   RequestTweaker
+	transport       *Transport
+	headers         []string
+	tweaker         RequestTweaker
+	retry           *RetryPolicy
+	breaker         *CircuitBreaker
+	limiter         *ConcurrencyLimiter
+	responseHeaders HeaderRules
 }
 
 func (u *SingleTransportUpstream) Headers() []string {
@@ -50,15 +116,49 @@ func (u *SingleTransportUpstream) Tweaker() RequestTweaker {
 	return u.tweaker
 }
 
-func (u *SingleTransportUpstream) Transport() *Transport {
+func (u *SingleTransportUpstream) RetryPolicy() *RetryPolicy {
+	return u.retry
+}
+
+func (u *SingleTransportUpstream) Breaker() *CircuitBreaker {
+	return u.breaker
+}
+
+func (u *SingleTransportUpstream) Limiter() *ConcurrencyLimiter {
+	return u.limiter
+}
+
+func (u *SingleTransportUpstream) ResponseHeaders() HeaderRules {
+	return u.responseHeaders
+}
+
+// exclude is ignored, a retry can only go to the one transport we have
+func (u *SingleTransportUpstream) Transport(req *Request, exclude ...*Transport) *Transport {
 	return u.transport
 }
 
+func (u *SingleTransportUpstream) Transports() []*Transport {
+	return []*Transport{u.transport}
+}
+
+// There's nothing to eject a single transport in favor of, so only
+// its circuit breaker cares
+func (u *SingleTransportUpstream) Report(transport *Transport, ok bool) {
+	recordBreaker(transport, ok)
+}
+
 type MultiTransportUpstream struct {
 	sync.RWMutex
-	transports []*Transport
-	headers    []string
-	tweaker    RequestTweaker
+	name            string
+	balancer        Balancer
+	outliers        *OutlierDetection
+	retry           *RetryPolicy
+	breaker         *CircuitBreaker
+	limiter         *ConcurrencyLimiter
+	transports      []*Transport
+	headers         []string
+	tweaker         RequestTweaker
+	responseHeaders HeaderRules
 }
 
 func (u *MultiTransportUpstream) Headers() []string {
@@ -69,13 +169,246 @@ func (u *MultiTransportUpstream) Tweaker() RequestTweaker {
 	return u.tweaker
 }
 
-func (u *MultiTransportUpstream) Transport() *Transport {
+func (u *MultiTransportUpstream) RetryPolicy() *RetryPolicy {
+	return u.retry
+}
+
+func (u *MultiTransportUpstream) Breaker() *CircuitBreaker {
+	return u.breaker
+}
+
+func (u *MultiTransportUpstream) Limiter() *ConcurrencyLimiter {
+	return u.limiter
+}
+
+func (u *MultiTransportUpstream) ResponseHeaders() HeaderRules {
+	return u.responseHeaders
+}
+
+// Picks a healthy, non-ejected, transport. If there are none, all transports
+// are considered (fail open): a health check that's wrong shouldn't take
+// the whole upstream down.
+func (u *MultiTransportUpstream) Transport(req *Request, exclude ...*Transport) *Transport {
+	defer u.RUnlock()
+	u.RLock()
+	if len(u.transports) == 0 {
+		return nil
+	}
+	candidates := available(u.transports, time.Now())
+	if len(exclude) > 0 {
+		candidates = without(candidates, exclude)
+	}
+	if u.balancer == nil {
+		return RandomBalancer{}.Pick(req, candidates)
+	}
+	return u.balancer.Pick(req, candidates)
+}
+
+func (u *MultiTransportUpstream) Transports() []*Transport {
 	defer u.RUnlock()
 	u.RLock()
-	return u.transports[rand.Intn(len(u.transports))]
+	return u.transports
+}
+
+func (u *MultiTransportUpstream) Report(transport *Transport, ok bool) {
+	recordBreaker(transport, ok)
+	d := u.outliers
+	if d == nil {
+		return
+	}
+	now := time.Now()
+	if d.record(transport, ok, now) == false {
+		return
+	}
+
+	u.eject(transport, now)
+}
+
+// Ejects the transport unless that would put more than MaxEjectedPercent of
+// the transports out. Counting and ejecting under the write lock stops
+// concurrent failures from going past the cap
+func (u *MultiTransportUpstream) eject(transport *Transport, now time.Time) {
+	defer u.Unlock()
+	u.Lock()
+	if transport.Ejected(now) {
+		return
+	}
+	ejected, total := 0, len(u.transports)
+	for _, t := range u.transports {
+		if t.Ejected(now) {
+			ejected++
+		}
+	}
+	if (ejected+1)*100 > total*u.outliers.MaxEjectedPercent {
+		return
+	}
+	duration := u.outliers.eject(transport, now)
+	Log.Warnf("upstream %s transport %s ejected for %s", u.name, transport.Address, duration)
+}
+
+func recordBreaker(transport *Transport, ok bool) {
+	if transport.Breaker != nil {
+		transport.Breaker.Record(ok)
+	}
+}
+
+// returns the transports which aren't in exclude, or all of them if
+// they're all excluded
+func without(transports []*Transport, exclude []*Transport) []*Transport {
+	candidates := make([]*Transport, 0, len(transports))
+outer:
+	for _, t := range transports {
+		for _, e := range exclude {
+			if t == e {
+				continue outer
+			}
+		}
+		candidates = append(candidates, t)
+	}
+	if len(candidates) == 0 {
+		return transports
+	}
+	return candidates
+}
+
+// returns the healthy and non-ejected transports, or all of them if none
+// are. Doesn't allocate in the common case where everything is fine
+func available(transports []*Transport, now time.Time) []*Transport {
+	i := 0
+	l := len(transports)
+	for ; i < l; i++ {
+		if transports[i].available(now) == false {
+			break
+		}
+	}
+	if i == l {
+		return transports
+	}
+	candidates := make([]*Transport, i, l)
+	copy(candidates, transports[:i])
+	for _, t := range transports[i+1:] {
+		if t.available(now) {
+			candidates = append(candidates, t)
+		}
+	}
+	if len(candidates) == 0 {
+		return transports
+	}
+	return candidates
 }
 
 type Transport struct {
 	*http.Transport
 	Address string
+
+	// The relative share of traffic this transport should get when
+	// the upstream uses the weighted balancer. Values < 1 are treated as 1
+	Weight int
+
+	// The deadline for an entire request, from sending it to reading the
+	// last byte of the response. 0 for no deadline
+	Timeout time.Duration
+
+	// The time to wait for the response headers once the request has been
+	// sent. 0 for no timeout
+	HeaderTimeout time.Duration
+
+	// An optional circuit breaker for this specific transport
+	Breaker *CircuitBreaker
+
+	outstanding int64
+
+	// set by the HealthChecker
+	unhealthy int32
+	streak    int
+
+	outlier outlier
+}
+
+// Whether the transport is passing its health checks. Transports of
+// upstreams without a health check are always healthy.
+func (t *Transport) Healthy() bool {
+	return atomic.LoadInt32(&t.unhealthy) == 0
+}
+
+// The number of requests currently being processed by this transport
+// (from the time the request is sent until the response body is closed)
+func (t *Transport) Outstanding() int64 {
+	return atomic.LoadInt64(&t.outstanding)
+}
+
+// Wraps the underlying http.Transport's RoundTrip to track the number
+// of outstanding requests
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt64(&t.outstanding, 1)
+	res, err := t.Transport.RoundTrip(req)
+	if err != nil {
+		atomic.AddInt64(&t.outstanding, -1)
+		return nil, err
+	}
+	if conn, ok := res.Body.(io.ReadWriteCloser); ok && res.StatusCode == http.StatusSwitchingProtocols {
+		// an upgraded connection, which is outstanding until it's closed
+		res.Body = &trackedConn{ReadWriteCloser: conn, transport: t}
+		return res, nil
+	}
+	res.Body = &trackedBody{ReadCloser: res.Body, transport: t}
+	return res, nil
+}
+
+func (t *Transport) available(now time.Time) bool {
+	return t.Healthy() && t.Ejected(now) == false && (t.Breaker == nil || t.Breaker.Ready(now))
+}
+
+func (t *Transport) weight() int {
+	if t.Weight < 1 {
+		return 1
+	}
+	return t.Weight
+}
+
+type trackedBody struct {
+	io.ReadCloser
+	once      sync.Once
+	transport *Transport
+}
+
+func (b *trackedBody) Close() error {
+	b.once.Do(func() {
+		atomic.AddInt64(&b.transport.outstanding, -1)
+	})
+	return b.ReadCloser.Close()
+}
+
+type trackedConn struct {
+	io.ReadWriteCloser
+	once      sync.Once
+	transport *Transport
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() {
+		atomic.AddInt64(&c.transport.outstanding, -1)
+	})
+	return c.ReadWriteCloser.Close()
+}
+
+type connectTimeoutKey struct{}
+
+// Carries a route's connect timeout, through the request's context, to the
+// transport's dialer
+func WithConnectTimeout(ctx context.Context, timeout time.Duration) context.Context {
+	return context.WithValue(ctx, connectTimeoutKey{}, timeout)
+}
+
+// Bounds a dial by the connect timeout carried by ctx or, when there isn't
+// one, by fallback. 0 for no timeout
+func ConnectContext(ctx context.Context, fallback time.Duration) (context.Context, context.CancelFunc) {
+	timeout := fallback
+	if t, ok := ctx.Value(connectTimeoutKey{}).(time.Duration); ok {
+		timeout = t
+	}
+	if timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, timeout)
 }
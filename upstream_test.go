@@ -1,8 +1,10 @@
 package garnish
 
 import (
+	"context"
 	. "github.com/karlseguin/expect"
 	"testing"
+	"time"
 )
 
 type UpstreamTests struct{}
@@ -19,7 +21,7 @@ func (_ UpstreamTests) RandomlyPicksATransport() {
 
 	hits := map[string]int{"a": 0, "b": 0}
 	for i := 0; i < 1000; i++ {
-		hits[u.Transport().Address]++
+		hits[u.Transport(nil).Address]++
 	}
 	d := hits["a"] - hits["b"]
 	if d < 0 {
@@ -27,3 +29,20 @@ func (_ UpstreamTests) RandomlyPicksATransport() {
 	}
 	Expect(d).Less.Than(10)
 }
+
+func (_ UpstreamTests) RoutesOverrideTheConnectTimeout() {
+	ctx, cancel := ConnectContext(context.Background(), time.Second)
+	deadline, _ := ctx.Deadline()
+	cancel()
+	Expect(time.Until(deadline) <= time.Second).To.Equal(true)
+
+	ctx, cancel = ConnectContext(WithConnectTimeout(context.Background(), time.Minute), time.Second)
+	deadline, _ = ctx.Deadline()
+	cancel()
+	Expect(time.Until(deadline) > time.Second).To.Equal(true)
+
+	ctx, cancel = ConnectContext(context.Background(), 0)
+	_, ok := ctx.Deadline()
+	cancel()
+	Expect(ok).To.Equal(false)
+}
@@ -0,0 +1,94 @@
+package garnish
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// When a response Varies, each variant is stored under the secondary key
+// plus the request's (normalised) values for the Vary headers. A marker is
+// stored under the secondary key itself: a NormalResponse without a status
+// whose Vary header names the headers to fold in and whose body lists the
+// variants stored so far (one key per line).
+
+// The request headers named by the response's Vary header, in canonical
+// form. all is true for Vary: *
+func varyFields(header http.Header) (fields []string, all bool) {
+	for _, value := range header["Vary"] {
+		for _, field := range strings.Split(value, ",") {
+			field = strings.TrimSpace(field)
+			if field == "*" {
+				return nil, true
+			}
+			if len(field) == 0 {
+				continue
+			}
+			field = http.CanonicalHeaderKey(field)
+			seen := false
+			for _, f := range fields {
+				if f == field {
+					seen = true
+					break
+				}
+			}
+			if seen == false {
+				fields = append(fields, field)
+			}
+		}
+	}
+	return fields, false
+}
+
+// The suffix added to the secondary key for the request's variant
+func varyKey(req *Request, fields []string) string {
+	var key strings.Builder
+	key.WriteString("\x00vary")
+	for _, field := range fields {
+		key.WriteByte('\x00')
+		for i, value := range req.Header[field] {
+			if i > 0 {
+				key.WriteByte(',')
+			}
+			key.WriteString(normaliseVaryValue(value))
+		}
+	}
+	return key.String()
+}
+
+// Lowercases the value and removes the whitespace around its elements, so
+// that "en-US, fr" and "en-us,fr" pick the same variant
+func normaliseVaryValue(value string) string {
+	parts := strings.Split(strings.ToLower(value), ",")
+	for i, part := range parts {
+		parts[i] = strings.TrimSpace(part)
+	}
+	return strings.Join(parts, ",")
+}
+
+// Checked through the interface since storages may wrap what they store
+func isVaryMarker(item CachedResponse) bool {
+	return item.Status() == 0
+}
+
+func newVaryMarker(fields []string, variants []string, expires time.Time) *NormalResponse {
+	return &NormalResponse{
+		header:  http.Header{"Vary": []string{strings.Join(fields, ", ")}},
+		body:    []byte(strings.Join(variants, "\n")),
+		expires: expires,
+	}
+}
+
+// The variants listed by a marker, nil if it doesn't vary by fields
+func markerVariants(marker CachedResponse, fields []string) []string {
+	if marker.Header().Get("Vary") != strings.Join(fields, ", ") {
+		return nil
+	}
+	var body bytes.Buffer
+	marker.Write(nil, &body)
+	if body.Len() == 0 {
+		return nil
+	}
+	return strings.Split(body.String(), "\n")
+}
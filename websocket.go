@@ -0,0 +1,204 @@
+package garnish
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Returned by the upstream middleware when the upstream accepted an Upgrade
+// (websocket) request. Rather than being written out, the client's
+// connection is hijacked and bytes are relayed between it and the upstream
+type UpgradeResponse struct {
+	header http.Header
+	conn   io.ReadWriteCloser
+	idle   time.Duration
+}
+
+// conn is the upgraded upstream connection (the body of a 101 response)
+func Upgraded(header http.Header, conn io.ReadWriteCloser, idle time.Duration) *UpgradeResponse {
+	return &UpgradeResponse{header: header, conn: conn, idle: idle}
+}
+
+func (r *UpgradeResponse) ContentLength() int {
+	return -1
+}
+
+func (r *UpgradeResponse) Write(runtime *Runtime, w io.Writer) {}
+
+func (r *UpgradeResponse) Status() int {
+	return http.StatusSwitchingProtocols
+}
+
+func (r *UpgradeResponse) Header() http.Header {
+	return r.header
+}
+
+func (r *UpgradeResponse) AddHeader(key, value string) Response {
+	r.header.Add(key, value)
+	return r
+}
+
+func (r *UpgradeResponse) ToCacheable(expires time.Time) CachedResponse {
+	return nil
+}
+
+func (r *UpgradeResponse) Close() {
+	r.conn.Close()
+}
+
+func (r *UpgradeResponse) Cached() bool {
+	return false
+}
+
+// The upgraded connections of a runtime. They're closed when the runtime
+// is replaced by a reload, clients are expected to reconnect (and thus
+// go through the new configuration)
+type Tunnels struct {
+	sync.Mutex
+	conns  map[*tunnel]struct{}
+	closed bool
+	active int64
+	opened int64
+	idled  int64
+	failed int64
+}
+
+type tunnel struct {
+	client   net.Conn
+	upstream io.Closer
+	last     int64
+}
+
+func NewTunnels() *Tunnels {
+	return &Tunnels{conns: make(map[*tunnel]struct{})}
+}
+
+// Closes every connection, and any which are opened afterwards
+func (t *Tunnels) Close() {
+	t.Lock()
+	defer t.Unlock()
+	t.closed = true
+	for tn := range t.conns {
+		tn.close()
+	}
+}
+
+func (t *Tunnels) Stats() map[string]int64 {
+	return map[string]int64{
+		"active": atomic.LoadInt64(&t.active),
+		"opened": atomic.SwapInt64(&t.opened, 0),
+		"idle":   atomic.SwapInt64(&t.idled, 0),
+		"failed": atomic.SwapInt64(&t.failed, 0),
+	}
+}
+
+func (r *Runtime) upgrade(out http.ResponseWriter, res *UpgradeResponse, req *Request) {
+	defer res.Close()
+	tunnels := r.Tunnels
+	hijacker, ok := out.(http.Hijacker)
+	if ok == false {
+		atomic.AddInt64(&tunnels.failed, 1)
+		req.Error("upgrade: connection can't be hijacked")
+		out.WriteHeader(500)
+		return
+	}
+	client, rw, err := hijacker.Hijack()
+	if err != nil {
+		atomic.AddInt64(&tunnels.failed, 1)
+		req.Errorf("upgrade hijack: %v", err)
+		return
+	}
+	defer client.Close()
+	// the server's read and write timeouts are still set on the connection
+	// and would cut the tunnel off
+	client.SetDeadline(time.Time{})
+
+	req.Infof("%d", http.StatusSwitchingProtocols)
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	res.header.Write(rw)
+	rw.WriteString("\r\n")
+	if err := rw.Flush(); err != nil {
+		atomic.AddInt64(&tunnels.failed, 1)
+		return
+	}
+
+	tn := &tunnel{client: client, upstream: res.conn, last: time.Now().UnixNano()}
+	if tunnels.track(tn) == false {
+		return
+	}
+	defer tunnels.untrack(tn)
+
+	// the client's reader might already hold frames sent right after the handshake
+	done := make(chan struct{}, 2)
+	go tn.pipe(res.conn, rw.Reader, done)
+	go tn.pipe(client, res.conn, done)
+
+	var tick <-chan time.Time
+	if res.idle > 0 {
+		ticker := time.NewTicker(res.idle / 2)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-done:
+			// either side going away ends the session
+			tn.close()
+			<-done
+			return
+		case <-tick:
+			if time.Since(time.Unix(0, atomic.LoadInt64(&tn.last))) >= res.idle {
+				atomic.AddInt64(&tunnels.idled, 1)
+				tn.close()
+				<-done
+				<-done
+				return
+			}
+		}
+	}
+}
+
+func (t *Tunnels) track(tn *tunnel) bool {
+	t.Lock()
+	defer t.Unlock()
+	if t.closed {
+		return false
+	}
+	t.conns[tn] = struct{}{}
+	atomic.AddInt64(&t.active, 1)
+	atomic.AddInt64(&t.opened, 1)
+	return true
+}
+
+func (t *Tunnels) untrack(tn *tunnel) {
+	t.Lock()
+	delete(t.conns, tn)
+	t.Unlock()
+	atomic.AddInt64(&t.active, -1)
+}
+
+func (tn *tunnel) pipe(dst io.Writer, src io.Reader, done chan struct{}) {
+	buffer := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buffer)
+		if n > 0 {
+			atomic.StoreInt64(&tn.last, time.Now().UnixNano())
+			if _, err := dst.Write(buffer[:n]); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	done <- struct{}{}
+}
+
+func (tn *tunnel) close() {
+	tn.client.Close()
+	tn.upstream.Close()
+}